@@ -0,0 +1,449 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+type blobFile struct {
+	id   uint64
+	size uint64
+
+	// number of blob versions containing the file, file is removed once it drops to 0
+	refs atomic.Int32
+}
+
+// blobVersion is an immutable set of live blob files, current version is replaced when files
+// are added or removed. Readers ref a version, so that files they may read are removed only
+// after they are done.
+type blobVersion struct {
+	files map[uint64]*blobFile
+	refs  atomic.Int32
+}
+
+func newBlobVersion(files map[uint64]*blobFile) *blobVersion {
+	v := &blobVersion{files: files}
+	v.refs.Store(1)
+	for _, bf := range files {
+		bf.refs.Add(1)
+	}
+	return v
+}
+
+// updateBlobs replace current blob version with one that adds and removes files, caller
+// should hold s.mu and unref the returned old version
+func (s *Storage) updateBlobs(add []*blobFile, remove ...uint64) *blobVersion {
+	files := make(map[uint64]*blobFile, len(s.blobs.files)+len(add))
+	for id, bf := range s.blobs.files {
+		files[id] = bf
+	}
+	for _, bf := range add {
+		files[bf.id] = bf
+	}
+	for _, id := range remove {
+		delete(files, id)
+	}
+
+	old := s.blobs
+	s.blobs = newBlobVersion(files)
+	return old
+}
+
+// refBlobs return current blob version with a reference added, caller must release it by unrefBlobs
+func (s *Storage) refBlobs() *blobVersion {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	s.blobs.refs.Add(1)
+	return s.blobs
+}
+
+// unrefBlobs release a reference of blob version, files no longer in any version are removed
+func (s *Storage) unrefBlobs(v *blobVersion) {
+	if v.refs.Add(-1) != 0 {
+		return
+	}
+	for _, bf := range v.files {
+		if bf.refs.Add(-1) != 0 {
+			continue
+		}
+		// close cached file handle once reads in progress are done
+		s.blobCache.Remove(bf.id)
+		if err := removeFile(fileName(BlobFile, bf.id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("lsm-tree: remove useless file err: %v", err)
+		}
+	}
+}
+
+// blobReader is a blob file opened through blob cache, it's closed once it's evicted and
+// no read is in progress
+type blobReader struct {
+	f    *os.File
+	refs atomic.Int32
+}
+
+func (r *blobReader) ref() bool {
+	for {
+		refs := r.refs.Load()
+		if refs <= 0 {
+			return false
+		}
+		if r.refs.CompareAndSwap(refs, refs+1) {
+			return true
+		}
+	}
+}
+
+func (r *blobReader) unref() {
+	if r.refs.Add(-1) != 0 {
+		return
+	}
+	if err := r.f.Close(); err != nil {
+		log.Printf("lsm-tree: close blob file err: %v", err)
+	}
+}
+
+/*
+blob file stores values larger than Config.BlobValueThreshold, values are only
+appended and never modified. Key is stored along with value, so garbage collection
+can check whether the value is still referenced.
+
+blob file format:
+
+	| len of key | len of value | key | value | ...
+*/
+type blobWriter struct {
+	id     uint64
+	f      *os.File
+	w      *bufio.Writer
+	offset uint64
+
+	buf [binary.MaxVarintLen64 * 2]byte
+}
+
+// newBlobWriter create blob file, writes are charged to rate limiter with pri
+func (s *Storage) newBlobWriter(pri ioPriority) (*blobWriter, error) {
+	id := s.newFileId()
+	f, err := openFile(fileName(BlobFile, id), false)
+	if err != nil {
+		return nil, err
+	}
+
+	var file io.Writer = f
+	if limiter := s.db.cfg.RateLimiter; limiter != nil {
+		file = &rateLimitedWriter{WriteCloser: f, limiter: limiter, pri: pri}
+	}
+	return &blobWriter{
+		id: id,
+		f:  f,
+		w:  bufio.NewWriter(file),
+	}, nil
+}
+
+func (w *blobWriter) add(key, val []byte) (blobIndex, error) {
+	n := binary.PutUvarint(w.buf[:], uint64(len(key)))
+	n += binary.PutUvarint(w.buf[n:], uint64(len(val)))
+	for _, b := range [][]byte{w.buf[:n], key, val} {
+		if _, err := w.w.Write(b); err != nil {
+			return blobIndex{}, err
+		}
+	}
+
+	idx := blobIndex{
+		fileId: w.id,
+		offset: w.offset + uint64(n+len(key)),
+		size:   uint64(len(val)),
+	}
+	w.offset += uint64(n + len(key) + len(val))
+	return idx, nil
+}
+
+func (w *blobWriter) finish() (*blobFile, error) {
+	if err := w.w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := w.f.Close(); err != nil {
+		return nil, err
+	}
+	return &blobFile{id: w.id, size: w.offset}, nil
+}
+
+type blobRecord struct {
+	key []byte
+	idx blobIndex
+}
+
+// readBlobRecords return all records of blob file
+func readBlobRecords(id uint64) ([]blobRecord, error) {
+	f, err := os.Open(fileName(BlobFile, id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	records := make([]blobRecord, 0)
+	offset := uint64(0)
+	var buf [binary.MaxVarintLen64]byte
+	for {
+		keyLen, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+		valLen, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+
+		key := make([]byte, keyLen)
+		if _, err := io.ReadFull(r, key); err != nil {
+			return nil, err
+		}
+		if _, err := r.Discard(int(valLen)); err != nil {
+			return nil, err
+		}
+
+		offset += uint64(binary.PutUvarint(buf[:], keyLen)+binary.PutUvarint(buf[:], valLen)) + keyLen
+		records = append(records, blobRecord{
+			key: key,
+			idx: blobIndex{fileId: id, offset: offset, size: valLen},
+		})
+		offset += valLen
+	}
+}
+
+func (s *Storage) addBlobFile(bf *blobFile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// no file is dropped, old version can be released under lock
+	s.unrefBlobs(s.updateBlobs([]*blobFile{bf}))
+	if err := s.saveManifest(); err != nil {
+		log.Printf("lsm-tree: save manifest err: %v", err)
+	}
+}
+
+// removeBlobFile drop blob file from current version, the file is removed once no version
+// or iterator refers to it
+func (s *Storage) removeBlobFile(id uint64) {
+	s.mu.Lock()
+	old := s.updateBlobs(nil, id)
+	if err := s.saveManifest(); err != nil {
+		log.Printf("lsm-tree: save manifest err: %v", err)
+	}
+	s.mu.Unlock()
+
+	s.unrefBlobs(old)
+}
+
+func (s *Storage) blobFiles() []*blobFile {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	files := make([]*blobFile, 0, len(s.blobs.files))
+	for _, bf := range s.blobs.files {
+		files = append(files, bf)
+	}
+	return files
+}
+
+// readBlob read value from blob file, caller should hold a blob version containing the file
+func (s *Storage) readBlob(idx blobIndex) ([]byte, error) {
+	r, err := s.openBlob(idx.fileId)
+	if err != nil {
+		return nil, err
+	}
+	defer r.unref()
+
+	val := make([]byte, idx.size)
+	if _, err := r.f.ReadAt(val, int64(idx.offset)); err != nil {
+		return nil, fmt.Errorf("read blob file %v err: %w", idx.fileId, err)
+	}
+	return val, nil
+}
+
+// openBlob return blob file from blob cache with a reference added, caller must unref it
+func (s *Storage) openBlob(id uint64) (*blobReader, error) {
+	for {
+		var err error
+		r := s.blobCache.Get(id, func() (interface{}, int64) {
+			f, openErr := os.Open(fileName(BlobFile, id))
+			if openErr != nil {
+				err = openErr
+				return nil, 0
+			}
+			r := &blobReader{f: f}
+			r.refs.Store(1)
+			return r, 1
+		})
+		if r == nil {
+			s.blobCache.Remove(id)
+			return nil, fmt.Errorf("open blob file %v err: %w", id, err)
+		}
+		// reader may be evicted and closed since it's got from cache
+		if r.(*blobReader).ref() {
+			return r.(*blobReader), nil
+		}
+	}
+}
+
+// separateValue move large value to blob file and return the value stored in sstable, it's
+// only called by flush
+func (d *DB) separateValue(bw **blobWriter, key, v []byte) ([]byte, error) {
+	kind, val, err := decodeValue(v)
+	if err != nil {
+		return nil, err
+	}
+	if kind != kindValue || len(val) < d.cfg.BlobValueThreshold {
+		return v, nil
+	}
+
+	if *bw == nil {
+		if *bw, err = d.storage.newBlobWriter(ioPriorityHigh); err != nil {
+			return nil, err
+		}
+	}
+	idx, err := (*bw).add(key, val)
+	if err != nil {
+		return nil, err
+	}
+	return encodeValue(kindBlobIndex, idx.encode()), nil
+}
+
+// resolveValue return user value from value stored in memtable or sstable
+func (d *DB) resolveValue(v []byte) ([]byte, error) {
+	kind, data, err := decodeValue(v)
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case kindValue:
+		return data, nil
+	case kindBlobIndex:
+		idx, err := decodeBlobIndex(data)
+		if err != nil {
+			return nil, err
+		}
+		return d.storage.readBlob(idx)
+	default:
+		return nil, fmt.Errorf("%w: unknown kind %v", errCorruptedValue, kind)
+	}
+}
+
+// GarbageCollectBlobs rewrite blob files whose ratio of referenced values is below Config.BlobGCLiveRatio,
+// referenced values are moved to a new blob file and the old file is removed once no reader
+// refers to it. It also runs every Config.BlobGCInterval in background.
+func (d *DB) GarbageCollectBlobs() error {
+	d.blobGCMu.Lock()
+	defer d.blobGCMu.Unlock()
+
+	for _, bf := range d.storage.blobFiles() {
+		records, err := readBlobRecords(bf.id)
+		if err != nil {
+			return err
+		}
+
+		live, liveSize, totalSize := make([]blobRecord, 0), uint64(0), uint64(0)
+		for _, rec := range records {
+			totalSize += rec.idx.size
+			if d.blobReferenced(rec) {
+				live = append(live, rec)
+				liveSize += rec.idx.size
+			}
+		}
+		if totalSize > 0 && float64(liveSize)/float64(totalSize) >= d.cfg.BlobGCLiveRatio {
+			continue
+		}
+
+		if err := d.rewriteBlobs(live); err != nil {
+			return err
+		}
+		d.storage.removeBlobFile(bf.id)
+	}
+	return nil
+}
+
+// goBlobGC garbage collect blob files every Config.BlobGCInterval until database is closed
+func (d *DB) goBlobGC() {
+	defer d.background.Done()
+	ticker := time.NewTicker(d.cfg.BlobGCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.closeChan:
+			return
+		case <-ticker.C:
+			if err := d.GarbageCollectBlobs(); err != nil {
+				log.Printf("lsm-tree: garbage collect blob files err: %v", err)
+			}
+		}
+	}
+}
+
+// blobReferenced report whether the newest version of key points to the record
+func (d *DB) blobReferenced(rec blobRecord) bool {
+	v, ok := d.get(rec.key)
+	if !ok {
+		return false
+	}
+	kind, data, err := decodeValue(v)
+	if err != nil || kind != kindBlobIndex {
+		return false
+	}
+	idx, err := decodeBlobIndex(data)
+	return err == nil && idx == rec.idx
+}
+
+// rewriteBlobs copy values to a new blob file and point keys to it
+func (d *DB) rewriteBlobs(records []blobRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	bw, err := d.storage.newBlobWriter(ioPriorityLow)
+	if err != nil {
+		return err
+	}
+	updates := make([]blobRecord, 0, len(records))
+	for _, rec := range records {
+		val, err := d.storage.readBlob(rec.idx)
+		if err != nil {
+			return err
+		}
+		idx, err := bw.add(rec.key, val)
+		if err != nil {
+			return err
+		}
+		updates = append(updates, blobRecord{key: rec.key, idx: idx})
+	}
+	bf, err := bw.finish()
+	if err != nil {
+		return err
+	}
+	d.storage.addBlobFile(bf)
+
+	for i, rec := range records {
+		d.writeMu.Lock()
+		// key may be updated during rewrite
+		if d.blobReferenced(rec) {
+			err = d.writeLocked(WriteOperationPutBlobIndex, rec.key, updates[i].idx.encode())
+		}
+		d.writeMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
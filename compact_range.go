@@ -0,0 +1,164 @@
+package lsm
+
+type CompactRangeOptions struct {
+	// ForceBottommost rewrites tables of the bottommost level in range, e.g. to apply a new table format
+	ForceBottommost bool
+}
+
+// CompactRange compact tables overlapping [start, end] level by level down to the bottommost
+// level, nil start or end means unbounded. Memtable is flushed first if it overlaps the range.
+// It blocks until compaction is done, opts can be nil.
+func (d *DB) CompactRange(start, end []byte, opts *CompactRangeOptions) error {
+	if opts == nil {
+		opts = &CompactRangeOptions{}
+	}
+
+	d.writeMu.Lock()
+	if d.memOverlap(start, end) {
+		if err := d.flushMemTable(); err != nil {
+			d.writeMu.Unlock()
+			return err
+		}
+	}
+	d.writeMu.Unlock()
+
+	// FIFO compaction keeps all tables in level 0
+	if _, ok := d.storage.policy.(*FIFOCompactionPolicy); ok {
+		return nil
+	}
+
+	d.compactMu.Lock()
+	defer d.compactMu.Unlock()
+
+	// tables of level 0 are at least compacted into base level
+	base := d.storage.baseLevel()
+	bottom := d.storage.bottommostLevel()
+	if bottom < base {
+		bottom = base
+	}
+	for level := 0; level < bottom; level++ {
+		outputLevel := level + 1
+		if level == 0 {
+			outputLevel = base
+		}
+		if err := d.compactRangeLevel(level, outputLevel, start, end); err != nil {
+			return err
+		}
+	}
+	if opts.ForceBottommost {
+		return d.compactRangeLevel(bottom, bottom, start, end)
+	}
+	return nil
+}
+
+// compactRangeLevel compact tables in level overlapping [start, end] into outputLevel
+func (d *DB) compactRangeLevel(level, outputLevel int, start, end []byte) error {
+	compact := d.storage.pickRangeCompaction(level, outputLevel, start, end)
+	if compact == nil {
+		return nil
+	}
+	return d.majorCompaction(compact)
+}
+
+// baseLevel return the level which level 0 is compacted into, it's deeper than level 1
+// with LeveledCompactionPolicy.DynamicLevelBytes
+func (s *Storage) baseLevel() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if p, ok := s.policy.(*LeveledCompactionPolicy); ok {
+		_, base := p.levelTargets(s)
+		return base
+	}
+	return 1
+}
+
+// bottommostLevel return the deepest level which has tables
+func (s *Storage) bottommostLevel() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for level := len(s.levels); level > 0; level-- {
+		if len(s.levels[level-1]) > 0 {
+			return level
+		}
+	}
+	return 0
+}
+
+// pickRangeCompaction return compaction of tables in level overlapping [start, end] into
+// outputLevel, nil if no table overlaps
+func (s *Storage) pickRangeCompaction(level, outputLevel int, start, end []byte) *compaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	comp := &compaction{
+		level:       level,
+		outputLevel: outputLevel,
+	}
+
+	var picked tables
+	if level == 0 {
+		picked = s.level0Overlap(start, end)
+		// newer table comes first
+		for i := len(picked) - 1; i >= 0; i-- {
+			comp.inputs = append(comp.inputs, tables{picked[i]})
+		}
+	} else {
+		for _, t := range s.levels[level-1] {
+			if (end == nil || s.cmp.Compare(t.minKey, end) <= 0) && (start == nil || s.cmp.Compare(t.maxKey, start) >= 0) {
+				picked = append(picked, t)
+			}
+		}
+		if len(picked) > 0 {
+			comp.inputs = append(comp.inputs, picked)
+		}
+	}
+	if len(picked) == 0 {
+		return nil
+	}
+
+	if outputLevel != level {
+		minKey, maxKey := s.keyRange(picked)
+		if overlap := s.overlapTables(outputLevel, minKey, maxKey); len(overlap) > 0 {
+			comp.inputs = append(comp.inputs, overlap)
+		}
+	}
+
+	allMin, allMax := s.keyRange(comp.allTables())
+	comp.grandparents = s.overlapTables(outputLevel+1, allMin, allMax)
+	return comp
+}
+
+// level0Overlap return tables of level 0 overlapping [start, end] directly or through other
+// tables in order of level 0, so no older table overlapping them is left behind
+func (s *Storage) level0Overlap(start, end []byte) tables {
+	picked := make(map[uint64]bool)
+	for expanded := true; expanded; {
+		expanded = false
+		for _, t := range s.level0 {
+			if picked[t.id] {
+				continue
+			}
+			if (end != nil && s.cmp.Compare(t.minKey, end) > 0) || (start != nil && s.cmp.Compare(t.maxKey, start) < 0) {
+				continue
+			}
+			picked[t.id] = true
+			expanded = true
+			if start != nil && s.cmp.Compare(t.minKey, start) < 0 {
+				start = t.minKey
+			}
+			if end != nil && s.cmp.Compare(t.maxKey, end) > 0 {
+				end = t.maxKey
+			}
+		}
+	}
+
+	ts := make(tables, 0, len(picked))
+	for _, t := range s.level0 {
+		if picked[t.id] {
+			ts = append(ts, t)
+		}
+	}
+	return ts
+}
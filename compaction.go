@@ -1,7 +1,12 @@
 package lsm
 
 import (
+	"log"
+	"lsm/compare"
 	"lsm/iterator"
+	"sort"
+	"sync"
+	"time"
 )
 
 type compactRange struct {
@@ -11,21 +16,87 @@ type compactRange struct {
 }
 
 type compaction struct {
-	level int
+	// level of the newest input and level of output tables
+	level, outputLevel int
 
-	tables [2]tables
+	// sorted runs to merge, newer run comes first, tables of a run don't overlap each other
+	inputs []tables
+	// inputs are deleted without output
+	deletion bool
+	// largest key of inputs of level, compaction pointer of level moves to it once compaction
+	// is applied, nil keeps the pointer
+	compactPointer []byte
+
+	// tables of level+2 overlapping the compaction
+	grandparents    tables
+	gpIdx           int
+	seenKey         bool
+	overlappedBytes uint64
+}
+
+// isTrivialMove report whether the only input table can be moved to output level without
+// rewriting, it mustn't overlap output level or too many grandparent tables
+func (c *compaction) isTrivialMove() bool {
+	if len(c.inputs) != 1 || len(c.inputs[0]) != 1 || c.outputLevel == c.level {
+		return false
+	}
+
+	size := uint64(0)
+	for _, t := range c.grandparents {
+		size += t.size
+	}
+	return size <= uint64(GrandparentOverlapFactor*FileSize)
+}
+
+func (c *compaction) allTables() tables {
+	ts := make(tables, 0)
+	for _, run := range c.inputs {
+		ts = append(ts, run...)
+	}
+	return ts
+}
+
+// shouldStopBefore report whether current output table should be finished before key,
+// so that a output table doesn't overlap too many grandparent tables, which makes
+// its later compaction expensive
+func (c *compaction) shouldStopBefore(cmp compare.Comparator, key []byte) bool {
+	for c.gpIdx < len(c.grandparents) && cmp.Compare(key, c.grandparents[c.gpIdx].maxKey) > 0 {
+		if c.seenKey {
+			c.overlappedBytes += c.grandparents[c.gpIdx].size
+		}
+		c.gpIdx += 1
+	}
+	c.seenKey = true
+
+	if c.overlappedBytes > uint64(GrandparentOverlapFactor*FileSize) {
+		c.overlappedBytes = 0
+		return true
+	}
+	return false
 }
 
 type compTableBuilder struct {
 	s *Storage
 	w *tWriter
+	// largest sequence number of compaction inputs
+	largestSeq uint64
+
+	// range tombstones to write, sorted by start key. Each output table gets the parts
+	// from lower to its last key.
+	tombstones []iterator.RangeTombstone
+	lower      []byte
 
 	tableInfo []*table
 }
 
+func (c *compTableBuilder) newTable() {
+	c.w = c.s.newTable(ioPriorityLow)
+	c.w.largestSeq = c.largestSeq
+}
+
 func (c *compTableBuilder) appendKV(key, val []byte) error {
 	if c.w == nil {
-		c.w = c.s.newTable()
+		c.newTable()
 	}
 	c.w.append(key, val)
 
@@ -36,7 +107,19 @@ func (c *compTableBuilder) needFlush() bool {
 	return c.w.estimateSize() >= FileSize
 }
 
-func (c *compTableBuilder) flush() error {
+// flush finish current table before key cut, nil cut means the end of compaction. A table
+// is written for range tombstones even if it has no key.
+func (c *compTableBuilder) flush(cut []byte) error {
+	ts := clipTombstones(c.s.cmp, c.tombstones, c.lower, cut)
+	c.lower = cut
+	if c.w == nil {
+		if len(ts) == 0 {
+			return nil
+		}
+		c.newTable()
+	}
+	c.w.addRangeTombstones(c.s.cmp, ts)
+
 	table, err := c.w.finish()
 	if err != nil {
 		return err
@@ -47,84 +130,331 @@ func (c *compTableBuilder) flush() error {
 	return nil
 }
 
-// finish clean buffer and return table
-func (c *compTableBuilder) finish() ([]*table, error) {
-	if c.w.estimateSize() > 0 {
-		if err := c.flush(); err != nil {
-			return nil, err
-		}
+// finish clean buffer and return tables, end is the end of compaction range
+func (c *compTableBuilder) finish(end []byte) ([]*table, error) {
+	if err := c.flush(end); err != nil {
+		return nil, err
 	}
 	return c.tableInfo, nil
 }
 
+// mergeTombstones sort tombstones by start key and merge overlapping ones
+func mergeTombstones(cmp compare.Comparator, ts []iterator.RangeTombstone) []iterator.RangeTombstone {
+	sorted := append([]iterator.RangeTombstone(nil), ts...)
+	sort.Slice(sorted, func(i, j int) bool { return cmp.Compare(sorted[i].Start, sorted[j].Start) < 0 })
+
+	merged := make([]iterator.RangeTombstone, 0, len(sorted))
+	for _, t := range sorted {
+		if n := len(merged); n > 0 && cmp.Compare(t.Start, merged[n-1].End) <= 0 {
+			if cmp.Compare(t.End, merged[n-1].End) > 0 {
+				merged[n-1].End = t.End
+			}
+			continue
+		}
+		merged = append(merged, t)
+	}
+	return merged
+}
+
+// clipTombstones return parts of sorted tombstones in [lower, upper), nil means unbounded
+func clipTombstones(cmp compare.Comparator, ts []iterator.RangeTombstone, lower, upper []byte) []iterator.RangeTombstone {
+	clipped := make([]iterator.RangeTombstone, 0)
+	for _, t := range ts {
+		if lower != nil && cmp.Compare(t.Start, lower) < 0 {
+			t.Start = lower
+		}
+		if upper != nil && cmp.Compare(t.End, upper) > 0 {
+			t.End = upper
+		}
+		if cmp.Compare(t.Start, t.End) < 0 {
+			clipped = append(clipped, t)
+		}
+	}
+	return clipped
+}
+
+// coveredBy report whether all keys of table are deleted by one of tombstones
+func coveredBy(cmp compare.Comparator, ts []iterator.RangeTombstone, t *table) bool {
+	for _, rt := range ts {
+		if cmp.Compare(rt.Start, t.minKey) <= 0 && cmp.Compare(t.maxKey, rt.End) < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// goCompaction flush memtables and dispatch compaction requests to compaction workers.
+// Flushes run here, so they are never blocked by long compactions.
 func (d *DB) goCompaction() {
+	defer d.background.Done()
+	for i := 0; i < d.cfg.MaxBackgroundCompactions; i++ {
+		d.background.Add(1)
+		go d.compactionWorker()
+	}
+
+	// some compaction, like dropping expired tables, isn't triggered by writes
+	ticker := time.NewTicker(CompactionCheckInterval)
+	defer ticker.Stop()
+
 	for {
 		select {
+		case <-d.closeChan:
+			return
 		case <-d.pauseChan:
 			// wait until resume
-			<-d.pauseChan
+			d.paused.Store(true)
+			// wait for running compactions
+			d.compactMu.Lock()
+			d.compactMu.Unlock()
+			select {
+			case <-d.pauseChan:
+				d.paused.Store(false)
+			case <-d.closeChan:
+				return
+			}
 		case <-d.memCompact:
 			if d.immtable != nil {
 				d.memCompaction()
 				continue
 			}
-		case cRange := <-d.levelCompact:
-			// TODO: record compaction history, to avoid trigger redundant compaction
-			if !d.storage.checkLevelCompaction(cRange.level) {
-				continue
+		case <-d.levelCompact:
+			d.signalWorkers()
+		case <-ticker.C:
+			d.signalWorkers()
+		}
+	}
+}
+
+// signalWorkers wake up an idle compaction worker, if all workers are busy, they
+// check for more compaction once current jobs are done
+func (d *DB) signalWorkers() {
+	select {
+	case d.compactSignal <- struct{}{}:
+	default:
+	}
+}
+
+func (d *DB) compactionWorker() {
+	defer d.background.Done()
+	for {
+		select {
+		case <-d.closeChan:
+			return
+		case <-d.compactSignal:
+			for d.compactOnce(true) {
 			}
-			compact := d.storage.pickCompaction(cRange.level)
-			d.majorCompaction(compact)
 		}
 	}
 }
 
-func (d *DB) majorCompaction(compact *compaction) {
-	iters := make([]iterator.Iterator, 0)
+// compactPending run compactions until compaction policy needs no more
+func (d *DB) compactPending() {
+	for d.compactOnce(false) {
+	}
+}
+
+// compactOnce run one compaction picked by compaction policy, return false if there is
+// nothing to compact or compaction failed. Tables of running compactions are excluded from picking, so
+// concurrent compactions never overlap. Background compaction stops once paused, pause
+// is checked under compactMu, so waiting for compactMu waits for all started compactions.
+func (d *DB) compactOnce(background bool) bool {
+	d.compactMu.RLock()
+	defer d.compactMu.RUnlock()
+
+	if background && d.paused.Load() {
+		return false
+	}
+
+	compact := d.storage.pickCompaction()
+	if compact == nil {
+		return false
+	}
+	// let another worker pick the next compaction in parallel
+	d.signalWorkers()
+	err := d.majorCompaction(compact)
+	d.storage.releaseCompaction(compact)
+	if err != nil {
+		// inputs are kept, compaction is retried on next check
+		log.Printf("lsm-tree: compaction err: %v", err)
+		return false
+	}
+	return true
+}
 
-	for i, levelFiles := range compact.tables {
-		if len(levelFiles) == 0 {
+// majorCompaction merge input tables into output level, levels are unchanged if it fails
+func (d *DB) majorCompaction(compact *compaction) error {
+	if compact.deletion {
+		d.storage.applyCompaction(compact, nil)
+		return nil
+	}
+	if compact.isTrivialMove() {
+		d.storage.moveTable(compact.inputs[0][0], compact.level, compact.outputLevel, compact.compactPointer)
+		return nil
+	}
+
+	blobs := d.storage.refBlobs()
+	defer d.storage.unrefBlobs(blobs)
+
+	// key ranges are compacted in parallel, outputs are installed together
+	bounds := d.subcompactionBounds(compact)
+	outputs := make([][]*table, len(bounds)+1)
+	errs := make([]error, len(bounds)+1)
+	wg := sync.WaitGroup{}
+	for i := range outputs {
+		var start, end []byte
+		if i > 0 {
+			start = bounds[i-1]
+		}
+		if i < len(bounds) {
+			end = bounds[i]
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			outputs[i], errs[i] = d.subcompaction(compact, start, end)
+		}(i)
+	}
+	wg.Wait()
+
+	newTables := make([]*table, 0)
+	for _, ts := range outputs {
+		newTables = append(newTables, ts...)
+	}
+	for _, err := range errs {
+		if err != nil {
+			// outputs of other subcompactions aren't installed
+			d.storage.removeTables(newTables)
+			return err
+		}
+	}
+
+	d.storage.applyCompaction(compact, newTables)
+	return nil
+}
+
+// subcompactionBounds split compaction into at most MaxSubcompactions key ranges at the
+// smallest keys of input tables, each range has about FileSize of input at least. Range i
+// is [bounds[i-1], bounds[i]), the first and last ranges are unbounded.
+func (d *DB) subcompactionBounds(compact *compaction) [][]byte {
+	ts := compact.allTables()
+	size := uint64(0)
+	for _, t := range ts {
+		size += t.size
+	}
+	n := d.cfg.MaxSubcompactions
+	if limit := int(size / uint64(FileSize)); limit < n {
+		n = limit
+	}
+	if n <= 1 {
+		return nil
+	}
+
+	keys := make([][]byte, 0, len(ts))
+	for _, t := range ts {
+		keys = append(keys, t.minKey)
+	}
+	sort.Slice(keys, func(i, j int) bool { return d.cmp.Compare(keys[i], keys[j]) < 0 })
+	// the smallest key can't split anything
+	uniq := make([][]byte, 0, len(keys))
+	for _, key := range keys[1:] {
+		if d.cmp.Compare(key, keys[0]) == 0 {
 			continue
 		}
-		if compact.level == 0 && i == 0 {
-			for _, table := range levelFiles {
-				iters = append(iters, d.storage.newIterator(table))
-			}
-		} else {
-			idxIter := levelFiles.newIndexIterator(d.storage, d.cmp)
-			iter := iterator.NewTwoLevelIterator(idxIter)
-			iters = append(iters, iter)
+		if len(uniq) == 0 || d.cmp.Compare(key, uniq[len(uniq)-1]) != 0 {
+			uniq = append(uniq, key)
 		}
 	}
+	if len(uniq)+1 < n {
+		n = len(uniq) + 1
+	}
 
-	compBuilder := &compTableBuilder{
-		s:         d.storage,
-		w:         nil,
-		tableInfo: make([]*table, 0),
+	// pick boundaries evenly
+	bounds := make([][]byte, 0, n-1)
+	for i := 1; i < n; i++ {
+		bounds = append(bounds, uniq[i*len(uniq)/n])
 	}
+	return bounds
+}
 
-	iter := iterator.NewMergeIterator(iters, d.cmp)
-	for ; iter.Valid(); iter.Next() {
-		compBuilder.appendKV(iter.Key(), iter.Value())
-		if compBuilder.needFlush() {
-			if err := compBuilder.flush(); err != nil {
-				panic(err)
+// subcompaction merge input keys in [start, end) into new tables, nil start or end
+// means unbounded. Range tombstones delete keys of older runs, tables entirely deleted
+// by them are dropped without being read.
+func (d *DB) subcompaction(compact *compaction, start, end []byte) ([]*table, error) {
+	refs := d.storage.newTableRefs()
+	defer refs.release()
+
+	iters := make([]iterator.Iterator, 0, len(compact.inputs))
+	tombstones := make([][]iterator.RangeTombstone, 0, len(compact.inputs))
+	newer := make([]iterator.RangeTombstone, 0)
+	for _, run := range compact.inputs {
+		live := make(tables, 0, len(run))
+		for _, t := range run {
+			if !coveredBy(d.cmp, newer, t) {
+				live = append(live, t)
+			}
+		}
+		if len(live) == 0 {
+			continue
+		}
+
+		if len(live) == 1 {
+			r, err := refs.open(live[0])
+			if err != nil {
+				return nil, err
 			}
+			iters = append(iters, r.NewIterator())
+		} else {
+			iters = append(iters, iterator.NewTwoLevelIterator(live.newIndexIterator(refs, d.cmp)))
 		}
+		ts := d.storage.rangeTombstones(refs, live)
+		tombstones = append(tombstones, ts)
+		newer = append(newer, ts...)
 	}
 
-	newTables, err := compBuilder.finish()
-	if err != nil {
-		panic(err)
+	// nothing is left for tombstones to delete in bottommost level
+	bottommost := d.storage.isBottommost(compact)
+	compBuilder := &compTableBuilder{
+		s:          d.storage,
+		w:          nil,
+		largestSeq: d.storage.largestSeq(compact.allTables()),
+		lower:      start,
+		tableInfo:  make([]*table, 0),
+	}
+	if !bottommost {
+		compBuilder.tombstones = clipTombstones(d.cmp, mergeTombstones(d.cmp, newer), start, end)
 	}
+	// each subcompaction tracks grandparent overlap of its own outputs
+	c := *compact
 
-	delTables := make([]*table, 0)
-	for _, tables := range compact.tables {
-		for _, t := range tables {
-			delTables = append(delTables, t)
+	iter := iterator.NewMergeIteratorWithTombstones(iters, tombstones, d.cmp)
+	if start != nil {
+		iter.Seek(start)
+	}
+	filter := d.newEntryFilter(compact.outputLevel, bottommost)
+	for ; iter.Valid(); iter.Next() {
+		if end != nil && d.cmp.Compare(iter.Key(), end) >= 0 {
+			break
 		}
+		if bottommost && isDeletion(iter.Value()) {
+			continue
+		}
+		val, keep, err := filter.filter(iter.Key(), iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		if !keep {
+			continue
+		}
+		if compBuilder.w != nil && (c.shouldStopBefore(d.cmp, iter.Key()) || compBuilder.needFlush()) {
+			if err := compBuilder.flush(iter.Key()); err != nil {
+				return nil, err
+			}
+		}
+		compBuilder.appendKV(iter.Key(), val)
 	}
-	d.storage.applyCompaction(compact.level, newTables, delTables)
+
+	return compBuilder.finish(end)
 }
 
 func (d *DB) memCompaction() {
@@ -134,21 +464,77 @@ func (d *DB) memCompaction() {
 	// TODO: combine multiple put requests into 1 thread, then it can avoid trigger many times of compaction
 	table.wait()
 
+	// blob files read by compaction filter aren't removed by garbage collection meanwhile
+	blobs := d.storage.refBlobs()
+	defer d.storage.unrefBlobs(blobs)
+
+	var bw *blobWriter
+	var w *tWriter
+	// level 0 is never the bottommost level
+	filter := d.newEntryFilter(0, false)
+	var last []byte
 	iter := table.NewIterator()
-	tWriter := d.storage.newTable()
 	for ; iter.Valid(); iter.Next() {
-		tWriter.append(iter.Key(), iter.Value())
-	}
+		// only the newest version of key is written, older versions follow it
+		if last != nil && d.cmp.Compare(last, iter.Key()) == 0 {
+			continue
+		}
+		last = iter.Key()
 
-	tInfo, err := tWriter.finish()
-	if err != nil {
-		d.errCompact <- err
-		return
+		val, keep, err := filter.filter(iter.Key(), iter.Value())
+		if err != nil {
+			d.setFlushError(err)
+			return
+		}
+		if !keep {
+			continue
+		}
+		if d.cfg.BlobValueThreshold > 0 {
+			if val, err = d.separateValue(&bw, iter.Key(), val); err != nil {
+				d.setFlushError(err)
+				return
+			}
+		}
+		if w == nil {
+			w = d.storage.newTable(ioPriorityHigh)
+			w.largestSeq = d.storage.nextSequence()
+		}
+		w.append(iter.Key(), val)
+	}
+	if ts := table.RangeTombstones(); len(ts) > 0 {
+		if w == nil {
+			w = d.storage.newTable(ioPriorityHigh)
+			w.largestSeq = d.storage.nextSequence()
+		}
+		w.addRangeTombstones(d.cmp, mergeTombstones(d.cmp, ts))
 	}
 
-	d.storage.addTable(0, tInfo)
+	// all entries may be dropped by compaction filter
+	if w != nil {
+		tInfo, err := w.finish()
+		if err != nil {
+			d.setFlushError(err)
+			return
+		}
+
+		blobs := make([]*blobFile, 0, 1)
+		if bw != nil {
+			bf, err := bw.finish()
+			if err != nil {
+				d.setFlushError(err)
+				return
+			}
+			blobs = append(blobs, bf)
+		}
+
+		d.storage.addTable(0, tInfo, blobs...)
+	}
 
 	d.mu.Lock()
 	d.immtable = nil
+	logNumber := d.mtable.logId
+	d.flushCond.Broadcast()
 	d.mu.Unlock()
+
+	d.storage.setLogNumber(logNumber)
 }
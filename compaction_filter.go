@@ -0,0 +1,105 @@
+package lsm
+
+import "sync/atomic"
+
+// FilterDecision tells flush and compaction what to do with an entry
+type FilterDecision int
+
+const (
+	// FilterKeep keeps the entry as is
+	FilterKeep FilterDecision = iota
+	// FilterRemove drops the entry
+	FilterRemove
+	// FilterChangeValue replaces value of the entry with the returned value
+	FilterChangeValue
+	// FilterStop keeps the entry, and the filter isn't invoked for the rest of
+	// the flush or compaction
+	FilterStop
+)
+
+// CompactionFilter is invoked on every entry written by memtable flush and compaction,
+// level is the level of output tables. Filter may be called concurrently by flush and
+// compactions, and must return the same decision for the same entry. Tables moved to
+// the next level without rewriting aren't filtered.
+//
+// A removed entry is replaced by a tombstone, so that older versions of the key in deeper
+// levels stay deleted. It's dropped outright if output level is the bottommost level of
+// its key range.
+type CompactionFilter interface {
+	Filter(level int, key, value []byte) (FilterDecision, []byte)
+}
+
+// CompactionFilterStats counts decisions of compaction filter since database is opened
+type CompactionFilterStats struct {
+	Kept    uint64
+	Removed uint64
+	Changed uint64
+	Stopped uint64
+}
+
+type filterCounters struct {
+	kept, removed, changed, stopped atomic.Uint64
+}
+
+// CompactionFilterStats return counters of compaction filter decisions
+func (d *DB) CompactionFilterStats() CompactionFilterStats {
+	return CompactionFilterStats{
+		Kept:    d.filterStats.kept.Load(),
+		Removed: d.filterStats.removed.Load(),
+		Changed: d.filterStats.changed.Load(),
+		Stopped: d.filterStats.stopped.Load(),
+	}
+}
+
+// entryFilter applies compaction filter to entries of one flush or compaction
+type entryFilter struct {
+	d     *DB
+	level int
+	// removed entries are dropped instead of replaced by tombstones
+	bottommost bool
+	// filter is no longer invoked once it returns FilterStop
+	stopped bool
+}
+
+func (d *DB) newEntryFilter(level int, bottommost bool) *entryFilter {
+	return &entryFilter{
+		d:          d,
+		level:      level,
+		bottommost: bottommost,
+		stopped:    d.cfg.CompactionFilter == nil,
+	}
+}
+
+// filter return the value to write, or false if the entry is dropped. Filter sees user
+// value, values stored in blob files are read, so caller should hold a blob version and
+// pass only the newest version of each key. A changed value is stored inline. Tombstones
+// are kept without being filtered.
+func (f *entryFilter) filter(key, v []byte) ([]byte, bool, error) {
+	if f.stopped || isDeletion(v) {
+		return v, true, nil
+	}
+	val, err := f.d.resolveValue(v)
+	if err != nil {
+		return nil, false, err
+	}
+
+	stats := &f.d.filterStats
+	decision, newVal := f.d.cfg.CompactionFilter.Filter(f.level, key, val)
+	switch decision {
+	case FilterRemove:
+		stats.removed.Add(1)
+		if f.bottommost {
+			return nil, false, nil
+		}
+		return encodeValue(kindDeletion, nil), true, nil
+	case FilterChangeValue:
+		stats.changed.Add(1)
+		return encodeValue(kindValue, newVal), true, nil
+	case FilterStop:
+		stats.stopped.Add(1)
+		f.stopped = true
+	default:
+		stats.kept.Add(1)
+	}
+	return v, true, nil
+}
@@ -1,9 +1,24 @@
 package compare
 
-import "bytes"
+import (
+	"bytes"
+	"encoding/binary"
+)
 
+// Comparator defines the total order of keys. Name is persisted in every
+// table and in the database metadata, a database must always be reopened
+// with a comparator of the same name.
 type Comparator interface {
 	Compare(a, b []byte) int
+	Name() string
+}
+
+// PrefixOrdered is implemented by comparators which keep keys with the same prefix
+// adjacent and right after the prefix itself, as bytewise order does. Prefix iteration
+// seeks to the prefix and stops at the first key without it only for such comparators.
+type PrefixOrdered interface {
+	Comparator
+	PrefixOrdered()
 }
 
 type BasicComparator struct{}
@@ -11,3 +26,45 @@ type BasicComparator struct{}
 func (c BasicComparator) Compare(a, b []byte) int {
 	return bytes.Compare(a, b)
 }
+
+func (c BasicComparator) Name() string {
+	return "lsm.BytewiseComparator"
+}
+
+func (c BasicComparator) PrefixOrdered() {}
+
+// ReverseBytewiseComparator orders keys in descending bytewise order
+type ReverseBytewiseComparator struct{}
+
+func (c ReverseBytewiseComparator) Compare(a, b []byte) int {
+	return bytes.Compare(b, a)
+}
+
+func (c ReverseBytewiseComparator) Name() string {
+	return "lsm.ReverseBytewiseComparator"
+}
+
+// Uint64BigEndianComparator orders 8 bytes keys as big-endian encoded uint64,
+// keys of other length fall back to bytewise order
+type Uint64BigEndianComparator struct{}
+
+func (c Uint64BigEndianComparator) Compare(a, b []byte) int {
+	if len(a) != 8 || len(b) != 8 {
+		return bytes.Compare(a, b)
+	}
+
+	x, y := binary.BigEndian.Uint64(a), binary.BigEndian.Uint64(b)
+	if x < y {
+		return -1
+	} else if x > y {
+		return 1
+	}
+	return 0
+}
+
+func (c Uint64BigEndianComparator) Name() string {
+	return "lsm.Uint64BigEndianComparator"
+}
+
+// PrefixOrdered is implemented since big-endian order of uint64 is bytewise order
+func (c Uint64BigEndianComparator) PrefixOrdered() {}
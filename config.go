@@ -1,6 +1,10 @@
 package lsm
 
-import "lsm/compare"
+import (
+	"lsm/compare"
+	"lsm/sstable"
+	"time"
+)
 
 const (
 	KB = 1024
@@ -11,15 +15,38 @@ var (
 	DefaultBlockSize    = 4 * KB
 	DefaultMemtableSize = 2 * MB
 
+	DefaultBloomBitsPerKey = 10
+
 	Level0FileNumber = 4
 	FileSize         = 2 * MB
 	Level1FilesSize  = 10 * MB
 	SizeMultiplier   = 10
 	MaximumLevel     = 10
+	// output table of compaction is finished early once it overlaps
+	// more than GrandparentOverlapFactor * FileSize of level+2
+	GrandparentOverlapFactor        = 10
+	DefaultMaxBackgroundCompactions = 2
+	DefaultMaxSubcompactions        = 4
+
+	// tombstones count as DeletionWeight entries of average size in compensated size of table
+	DeletionWeight = 2
+
+	// a table is compacted after size / SeekCostBytes lookups read it without finding
+	// key, and at least MinAllowedSeeks
+	SeekCostBytes   = 16 * KB
+	MinAllowedSeeks = 100
+	// iterators sample a key for seek compaction every ReadBytesPeriod bytes on average
+	ReadBytesPeriod = MB
+
+	// interval of checking compaction not triggered by writes
+	CompactionCheckInterval = time.Minute
 
 	FileCacheCapacity  = 500
 	BlockCacheCapacity = 8 * MB
 
+	DefaultBlobGCLiveRatio = 0.5
+	DefaultBlobGCInterval  = 10 * time.Minute
+
 	DirectoryPath = "./lsm"
 
 	DefaultComparator = compare.BasicComparator{}
@@ -30,8 +57,115 @@ type FileType int
 const (
 	SstableFile FileType = iota
 	LogFile
+	ManifestFile
+	BlobFile
 )
 
 type Config struct {
-	// TODO: customize config
+	// Dir is the directory of the database, an existing database in Dir is
+	// reopened. If empty, a new directory is created under ./lsm.
+	Dir string
+
+	// Comparator defines the order of keys, default: DefaultComparator.
+	// It must have the same name as the one the database was created with.
+	Comparator compare.Comparator
+
+	// FilterPolicy builds filters of sstables,
+	// default: bloom filter with DefaultBloomBitsPerKey bits per key
+	FilterPolicy sstable.FilterPolicy
+	// FullFilter builds one filter for a whole sstable instead of one per data block
+	FullFilter bool
+	// PrefixExtractor adds prefix of keys to sstable filters, so that iterators
+	// with IteratorOptions.Prefix can skip tables and blocks without the prefix
+	PrefixExtractor sstable.PrefixExtractor
+	// PartitionedIndex splits index and filter of sstables into partitions which
+	// are loaded through block cache on demand, instead of being pinned in memory
+	PartitionedIndex bool
+	// DataBlockHashIndex adds a hash index to data blocks for faster point lookups,
+	// keys that compare equal must be bytewise equal
+	DataBlockHashIndex bool
+
+	// Mmap reads sstables through read-only memory mapping instead of file reads,
+	// blocks refer to the mapping directly and bypass block cache. Linux only.
+	Mmap bool
+
+	// BlobValueThreshold moves values of at least this size into blob files when
+	// memtable is flushed, sstables only keep pointers to them so compaction
+	// doesn't rewrite large values. 0 disables key-value separation.
+	BlobValueThreshold int
+	// BlobGCLiveRatio is the ratio of referenced values below which a blob file is
+	// rewritten by DB.GarbageCollectBlobs, default: DefaultBlobGCLiveRatio
+	BlobGCLiveRatio float64
+	// BlobGCInterval is the interval of running DB.GarbageCollectBlobs in background
+	// if BlobValueThreshold > 0, default: DefaultBlobGCInterval
+	BlobGCInterval time.Duration
+
+	// CompactionPolicy decides when and which tables are compacted,
+	// default: LeveledCompactionPolicy
+	CompactionPolicy CompactionPolicy
+	// MaxBackgroundCompactions is the number of compactions running concurrently,
+	// memtables are flushed separately. default: DefaultMaxBackgroundCompactions
+	MaxBackgroundCompactions int
+	// MaxSubcompactions is the number of key ranges a large compaction is split into,
+	// ranges are compacted in parallel. default: DefaultMaxSubcompactions
+	MaxSubcompactions int
+	// CompactionFilter drops or rewrites entries when memtables are flushed and
+	// tables are compacted, nil keeps all entries
+	CompactionFilter CompactionFilter
+	// RateLimiter limits write rate of flushes, compactions and blob garbage collection,
+	// including blob files they write, flushes have priority over the others. nil means
+	// unlimited.
+	RateLimiter *RateLimiter
+}
+
+type IteratorOptions struct {
+	// Prefix restricts iterator to keys with the prefix. Filters are only used
+	// to skip tables and blocks if Prefix is produced by Config.PrefixExtractor.
+	// Unless Config.Comparator is compare.PrefixOrdered, e.g. reverse bytewise order,
+	// all keys are scanned to find those with the prefix.
+	Prefix []byte
+}
+
+func (c *Config) tableOptions() *sstable.Options {
+	return &sstable.Options{
+		Comparator:   c.Comparator,
+		BlockSize:    DefaultBlockSize,
+		FilterPolicy: c.FilterPolicy,
+		FullFilter:   c.FullFilter,
+
+		PrefixExtractor:  c.PrefixExtractor,
+		PartitionedIndex: c.PartitionedIndex,
+
+		DataBlockHashIndex: c.DataBlockHashIndex,
+	}
+}
+
+func (c *Config) sanitize() *Config {
+	cfg := Config{}
+	if c != nil {
+		cfg = *c
+	}
+
+	if cfg.Comparator == nil {
+		cfg.Comparator = DefaultComparator
+	}
+	if cfg.FilterPolicy == nil {
+		cfg.FilterPolicy = sstable.NewBloomFilterPolicy(DefaultBloomBitsPerKey)
+	}
+	if cfg.CompactionPolicy == nil {
+		cfg.CompactionPolicy = NewLeveledCompactionPolicy()
+	}
+	if cfg.MaxBackgroundCompactions <= 0 {
+		cfg.MaxBackgroundCompactions = DefaultMaxBackgroundCompactions
+	}
+	if cfg.MaxSubcompactions <= 0 {
+		cfg.MaxSubcompactions = DefaultMaxSubcompactions
+	}
+	if cfg.BlobGCLiveRatio == 0 {
+		cfg.BlobGCLiveRatio = DefaultBlobGCLiveRatio
+	}
+	if cfg.BlobGCInterval <= 0 {
+		cfg.BlobGCInterval = DefaultBlobGCInterval
+	}
+	return &cfg
 }
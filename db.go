@@ -1,9 +1,13 @@
 package lsm
 
 import (
+	"io"
+	"log"
 	"lsm/compare"
 	"lsm/iterator"
+	"math/rand"
 	"sync"
+	"sync/atomic"
 )
 
 type DB struct {
@@ -13,85 +17,337 @@ type DB struct {
 	storage *Storage
 	journal *journal
 	cmp     compare.Comparator
+	cfg     *Config
 
 	mu sync.RWMutex
+	// serialize writes, so garbage collection of blob files can update a key
+	// only if it isn't overwritten
+	writeMu  sync.Mutex
+	blobGCMu sync.Mutex
+	// read-locked by each background compaction, write-locked to stop compaction
+	// when levels must be stable, e.g. ingestion
+	compactMu sync.RWMutex
+	// signaled when immutable memtable is flushed
+	flushCond *sync.Cond
 
-	memCompact   chan bool
-	levelCompact chan compactRange
-	errCompact   chan error
+	memCompact    chan bool
+	levelCompact  chan compactRange
+	compactSignal chan struct{}
+	closeChan     chan struct{}
+	// background goroutines, which are waited for by Close before journal is finished
+	background sync.WaitGroup
+	// first error of memtable flush, writes fail once it's set, guarded by mu
+	flushErr error
+
+	filterStats filterCounters
 
 	// for testing
 	pauseChan chan struct{}
+	paused    atomic.Bool
 }
 
 func New() *DB {
+	db, err := Open(nil)
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
+// Open create a database or reopen the existing one in cfg.Dir
+func Open(cfg *Config) (*DB, error) {
+	cfg = cfg.sanitize()
 	db := &DB{
 		memCompact:   make(chan bool, 3),
 		levelCompact: make(chan compactRange, 5),
-		errCompact:   make(chan error),
-		pauseChan:    make(chan struct{}),
+		// one pending signal per worker
+		compactSignal: make(chan struct{}, cfg.MaxBackgroundCompactions),
+		closeChan:     make(chan struct{}),
+		pauseChan:     make(chan struct{}),
+
+		cmp: cfg.Comparator,
+		cfg: cfg,
+	}
+
+	storage, err := NewStorage(db)
+	if err != nil {
+		return nil, err
+	}
+	db.storage = storage
+	db.flushCond = sync.NewCond(&db.mu)
 
-		cmp: DefaultComparator,
+	logs, err := storage.logFiles()
+	if err != nil {
+		return nil, err
 	}
-	db.storage = NewStorage(db)
 	db.newMem()
+	if err := db.recoverJournal(logs); err != nil {
+		return nil, err
+	}
 
+	db.background.Add(1)
 	go db.goCompaction()
+	if cfg.BlobValueThreshold > 0 {
+		db.background.Add(1)
+		go db.goBlobGC()
+	}
 
-	return db
+	return db, nil
+}
+
+// Close stop background compaction and wait for it, then close journal. Data not yet flushed is recovered from journal on next open
+func (d *DB) Close() {
+	close(d.closeChan)
+	d.background.Wait()
+	d.journal.Finish()
 }
 
-func (d *DB) Put(key, val []byte) {
-	d.journal.WriteRecord(WriteOperationPut, key, val)
+// recoverJournal replay journal files into current memtable
+func (d *DB) recoverJournal(logs []uint64) error {
+	for _, id := range logs {
+		f, err := openFile(fileName(LogFile, id), true)
+		if err != nil {
+			return err
+		}
+
+		r := NewJournalReader(f)
+		for {
+			wop, data, err := r.ReadRecord()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				f.Close()
+				return err
+			}
+
+			switch wop {
+			case WriteOperationPut:
+				d.mtable.Put(data[0], encodeValue(kindValue, data[1]))
+			case WriteOperationPutBlobIndex:
+				d.mtable.Put(data[0], encodeValue(kindBlobIndex, data[1]))
+			case WriteOperationDelete:
+				d.mtable.Put(data[0], encodeValue(kindDeletion, nil))
+			case WriteOperationDeleteRange:
+				d.mtable.DeleteRange(data[0], data[1])
+			}
+		}
+		f.Close()
+	}
+	return nil
+}
+
+// Put write key and value, it fails once flushing memtable failed
+func (d *DB) Put(key, val []byte) error {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	return d.writeLocked(WriteOperationPut, key, val)
+}
+
+// Delete write a tombstone for key, it fails once flushing memtable failed
+func (d *DB) Delete(key []byte) error {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	return d.writeLocked(WriteOperationDelete, key, nil)
+}
+
+// DeleteRange delete keys in [start, end) with a range tombstone, instead of a tombstone
+// per key. It does nothing if start isn't less than end.
+func (d *DB) DeleteRange(start, end []byte) error {
+	if d.cmp.Compare(start, end) >= 0 {
+		return nil
+	}
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	return d.writeLocked(WriteOperationDeleteRange, start, end)
+}
+
+// writeLocked write a record into journal and memtable, caller should hold d.writeMu.
+// For DeleteRange, key and val are start and end of the range.
+func (d *DB) writeLocked(wop WriteOperation, key, val []byte) error {
+	if err := d.flushError(); err != nil {
+		return err
+	}
 
 	mtable, _ := d.getMemTables(false)
-	mtable.Put(key, val)
+	switch wop {
+	case WriteOperationDelete:
+		d.journal.WriteRecord(wop, key)
+		mtable.Put(key, encodeValue(kindDeletion, nil))
+	case WriteOperationDeleteRange:
+		d.journal.WriteRecord(wop, key, val)
+		mtable.DeleteRange(key, val)
+	case WriteOperationPutBlobIndex:
+		d.journal.WriteRecord(wop, key, val)
+		mtable.Put(key, encodeValue(kindBlobIndex, val))
+	default:
+		d.journal.WriteRecord(wop, key, val)
+		mtable.Put(key, encodeValue(kindValue, val))
+	}
 	mtable.unref()
 
 	if mtable.estimateSize() >= DefaultMemtableSize {
 		d.mu.Lock()
-		if d.immtable != mtable {
-			d.frozenMem()
-			d.newMem()
-
-			d.memCompact <- true
+		defer d.mu.Unlock()
+		// immutable memtable is readable until it's flushed, so it can't be replaced before
+		for d.immtable != nil && d.flushErr == nil {
+			d.flushCond.Wait()
 		}
-		d.mu.Unlock()
+		if d.flushErr != nil {
+			return d.flushErr
+		}
+		d.frozenMem()
+		d.newMem()
+		d.memCompact <- true
 	}
+	return nil
 }
 
 func (d *DB) Get(key []byte) []byte {
+	// blob file the value points to isn't removed until it's read
+	blobs := d.storage.refBlobs()
+	defer d.storage.unrefBlobs(blobs)
+
+	v, ok := d.get(key)
+	if !ok || isDeletion(v) {
+		return nil
+	}
+	val, err := d.resolveValue(v)
+	if err != nil {
+		log.Printf("lsm-tree: %v", err)
+		return nil
+	}
+	return val
+}
+
+// get return value stored in memtable or sstable, which may be a pointer to blob file or
+// a tombstone
+func (d *DB) get(key []byte) ([]byte, bool) {
 	mtable, immtable := d.getMemTables(true)
 	if val, ok := mtable.Get(key); ok {
-		return val
+		return val, true
 	}
 
 	if immtable != nil {
 		if val, ok := immtable.Get(key); ok {
-			return val
+			return val, true
 		}
 	}
 
-	if val, ok := d.storage.get(key); ok {
-		return val
+	return d.storage.get(key)
+}
+
+// NewIterator return iterator over whole database, opts can be nil. Iterator must be closed
+// after use, tables it reads are kept until then.
+func (d *DB) NewIterator(opts *IteratorOptions) *DBIterator {
+	var prefix []byte
+	if opts != nil {
+		prefix = opts.Prefix
 	}
-	return nil
+
+	// pinned before tables are read, so that blob files they point to stay
+	blobs := d.storage.refBlobs()
+	mtable, immtable := d.getMemTables(true)
+	return d.newIterator(mtable, immtable, d.storage.refVersion(), blobs, prefix)
 }
 
-func (d *DB) NewIterator() iterator.Iterator {
+// newIterator return iterator over memtables and tables of version, version and blobs are
+// released when iterator is closed
+func (d *DB) newIterator(mtable, immtable *MemTable, v *version, blobs *blobVersion, prefix []byte) *DBIterator {
 	iters := make([]iterator.Iterator, 0)
+	tombstones := make([][]iterator.RangeTombstone, 0)
 
-	mtable, immtable := d.getMemTables(true)
 	iters = append(iters, mtable.NewIterator())
+	tombstones = append(tombstones, mtable.RangeTombstones())
 
 	if immtable != nil {
 		iters = append(iters, immtable.NewIterator())
+		tombstones = append(tombstones, immtable.RangeTombstones())
+	}
+
+	refs := d.storage.newTableRefs()
+	tableIters, tableTombstones := d.storage.getIterators(v, refs, prefix)
+	iters = append(iters, tableIters...)
+	tombstones = append(tombstones, tableTombstones...)
+
+	var iter iterator.Iterator = iterator.NewMergeIteratorWithTombstones(iters, tombstones, d.cmp)
+	if prefix != nil {
+		iter = iterator.NewPrefixIterator(iter, prefix, d.cmp)
+	}
+	return &DBIterator{Iterator: iter, db: d, refs: refs, v: v, blobs: blobs, bytesUntilSample: readSamplePeriod()}
+}
+
+// DBIterator resolve values stored in blob files, skip deleted keys, and sample keys read
+// for seek compaction
+type DBIterator struct {
+	iterator.Iterator
+	db    *DB
+	refs  *tableRefs
+	v     *version
+	blobs *blobVersion
+
+	bytesUntilSample int
+}
+
+// Close release tables and blob files read by iterator, keys and values returned by it
+// mustn't be used afterwards
+func (i *DBIterator) Close() {
+	i.refs.release()
+	if i.v != nil {
+		i.db.storage.unrefVersion(i.v)
+		i.v = nil
 	}
+	if i.blobs != nil {
+		i.db.storage.unrefBlobs(i.blobs)
+		i.blobs = nil
+	}
+}
+
+func (i *DBIterator) First() {
+	i.Iterator.First()
+	i.skipDeleted()
+}
+
+func (i *DBIterator) Next() {
+	i.Iterator.Next()
+	i.skipDeleted()
+}
 
-	iters = append(iters, d.storage.getIterators()...)
+func (i *DBIterator) Seek(key []byte) {
+	i.Iterator.Seek(key)
+	i.skipDeleted()
+}
+
+// skipDeleted move to the first key that isn't a tombstone, tombstones are sampled too
+func (i *DBIterator) skipDeleted() {
+	for i.sample(); i.Valid() && isDeletion(i.Iterator.Value()); i.sample() {
+		i.Iterator.Next()
+	}
+}
 
-	mergeIter := iterator.NewMergeIterator(iters, d.cmp)
-	return mergeIter
+func (i *DBIterator) Value() []byte {
+	val, err := i.db.resolveValue(i.Iterator.Value())
+	if err != nil {
+		log.Printf("lsm-tree: %v", err)
+		return nil
+	}
+	return val
+}
+
+// sample current key once about ReadBytesPeriod bytes are read
+func (i *DBIterator) sample() {
+	if !i.Valid() {
+		return
+	}
+	i.bytesUntilSample -= len(i.Key()) + len(i.Iterator.Value())
+	for i.bytesUntilSample < 0 {
+		i.bytesUntilSample += readSamplePeriod()
+		i.db.storage.recordReadSample(i.Key())
+	}
+}
+
+// readSamplePeriod is random, so that keys at fixed positions aren't always sampled
+func readSamplePeriod() int {
+	return rand.Intn(2*ReadBytesPeriod) + 1
 }
 
 func (d *DB) frozenMem() {
@@ -114,10 +370,52 @@ func (d *DB) getMemTables(readonly bool) (m, imm *MemTable) {
 	return m, imm
 }
 
+// flushMemTable write memtable to level 0 and wait until it's done, background compaction must be running
+func (d *DB) flushMemTable() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for d.immtable != nil && d.flushErr == nil {
+		d.flushCond.Wait()
+	}
+	if d.flushErr != nil || d.mtable.estimateSize() == 0 {
+		return d.flushErr
+	}
+
+	d.frozenMem()
+	d.newMem()
+	d.memCompact <- true
+	for d.immtable != nil && d.flushErr == nil {
+		d.flushCond.Wait()
+	}
+	return d.flushErr
+}
+
+// flushError return error of failed memtable flush
+func (d *DB) flushError() error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.flushErr
+}
+
+// setFlushError record error of memtable flush, immutable memtable is kept and recovered
+// from journal on next open
+func (d *DB) setFlushError(err error) {
+	log.Printf("lsm-tree: flush memtable err: %v", err)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.flushErr == nil {
+		d.flushErr = err
+	}
+	d.flushCond.Broadcast()
+}
+
 func (d *DB) newMem() {
+	id := d.storage.newFileId()
 	d.mtable = NewMemTable(d.cmp)
+	d.mtable.logId = id
 
-	id := d.storage.newFileId()
 	f, err := openFile(fileName(LogFile, id), false)
 	if err != nil {
 		panic(err)
@@ -126,6 +424,7 @@ func (d *DB) newMem() {
 	if d.journal == nil {
 		d.journal = NewJournal(f)
 	} else {
+		d.journal.Finish()
 		d.journal.Reset(f)
 	}
 }
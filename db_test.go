@@ -1,10 +1,21 @@
 package lsm
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"lsm/compare"
+	cache "lsm/lru-cache"
+	"lsm/sstable"
+	"math"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -67,6 +78,16 @@ func (d *testDB) pauseCompactGoroutine() {
 	d.db.pauseChan <- struct{}{}
 }
 
+// stopCompaction pause compaction goroutine and wait for running compactions
+func (d *testDB) stopCompaction() {
+	d.pauseCompactGoroutine()
+	for !d.db.paused.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	d.db.compactMu.Lock()
+	d.db.compactMu.Unlock()
+}
+
 func (d *testDB) memCompaction() {
 	d.db.frozenMem()
 	d.db.newMem()
@@ -139,6 +160,40 @@ func TestDB_FrozenMemtable(t *testing.T) {
 	d.get(key, val)
 }
 
+func TestDB_FrozenMemtableFlushing(t *testing.T) {
+	d := newTestDB(t)
+	d.stopCompaction()
+
+	nRec := d.bulkPut(2 * MB)
+	assert.NotNil(t, d.db.immtable)
+
+	// a full memtable isn't frozen until the immutable one is flushed
+	done := make(chan struct{})
+	go func() {
+		d.bulkPutFrom(2*MB, nRec)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("immutable memtable is replaced before it's flushed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	key, val := getKV(0)
+	d.get(key, val)
+
+	// resume flush
+	d.pauseCompactGoroutine()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("write isn't unblocked by flush")
+	}
+	for i := 0; i < 2*nRec; i++ {
+		key, val := getKV(i)
+		d.get(key, val)
+	}
+}
+
 func TestDB_MemCompaction(t *testing.T) {
 	d := newTestDB(t)
 	d.pauseCompactGoroutine()
@@ -199,7 +254,9 @@ func TestDB_MajorCompaction(t *testing.T) {
 	t.Log("wait for major compaction")
 	time.Sleep(1 * time.Second)
 
-	d.assertLevelFilesNum(0, 1)
+	// output of level 0 is larger than 3 KB with index, filter and properties, levels are
+	// rechecked after each compaction, so it moves on to level 2 without waiting for a flush
+	d.assertLevelFilesNum(0, 0, 1)
 
 	for i := 0; i < nRec; i++ {
 		key, val := getKV(i)
@@ -214,10 +271,1634 @@ func TestDB_MajorCompaction(t *testing.T) {
 	t.Log("wait for major compaction")
 	time.Sleep(1 * time.Second)
 
-	d.assertLevelFilesNum(0, 1, 1)
+	// level 2 grows beyond 6 KB and one of its tables moves on to level 3
+	d.assertLevelFilesNum(0, 0, 1, 1)
+
+	for i := 0; i < nRec; i++ {
+		key, val := getKV(i)
+		d.get(key, val)
+	}
+}
+
+func (d *testDB) reopen(cfg *Config) error {
+	d.db.Close()
+
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	cfg.Dir = DirectoryPath
+	db, err := Open(cfg)
+	if err != nil {
+		return err
+	}
+	d.db, d.storage = db, db.storage
+	return nil
+}
+
+func TestDB_Reopen(t *testing.T) {
+	d := newTestDB(t)
+	d.pauseCompactGoroutine()
+
+	nRec := d.bulkPut(1 * KB)
+	d.memCompaction()
+	// only recorded in journal
+	nRec += d.bulkPutFrom(1*KB, nRec)
+
+	assert.NoError(t, d.reopen(nil))
+	d.assertLevelFilesNum(1)
+	for i := 0; i < nRec; i++ {
+		key, val := getKV(i)
+		d.get(key, val)
+	}
+}
+
+func TestDB_ComparatorMismatch(t *testing.T) {
+	d := newTestDB(t)
+	d.pauseCompactGoroutine()
+
+	d.bulkPut(1 * KB)
+	d.memCompaction()
+
+	tInfo := d.storage.level0[0]
+	f, err := openFile(tInfo.getTableName(), true)
+	assert.NoError(t, err)
+	_, err = sstable.NewTableReader(f, &sstable.Options{Comparator: compare.ReverseBytewiseComparator{}}, tInfo.size, cache.NewLRUCache(1*MB))
+	assert.ErrorContains(t, err, "lsm.BytewiseComparator")
+
+	err = d.reopen(&Config{Comparator: compare.ReverseBytewiseComparator{}})
+	assert.ErrorContains(t, err, "lsm.ReverseBytewiseComparator")
+}
+
+func TestDB_ReverseComparator(t *testing.T) {
+	db, err := Open(&Config{Comparator: compare.ReverseBytewiseComparator{}})
+	assert.NoError(t, err)
+	d := &testDB{db: db, storage: db.storage, t: t}
+	d.pauseCompactGoroutine()
+
+	d.put("k1", "v1")
+	d.put("k3", "v3")
+	d.memCompaction()
+	d.put("k2", "v2")
+
+	keys := make([]string, 0)
+	iter := d.db.NewIterator(nil)
+	for ; iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	iter.Close()
+	assert.Equal(t, []string{"k3", "k2", "k1"}, keys)
+	d.get("k1", "v1")
+	d.get("k3", "v3")
+
+	// keys with prefix come before the prefix itself
+	d.put("k31", "v31")
+	d.put("k4", "v4")
+	d.memCompaction()
+	d.put("k30", "v30")
+	scan := func(prefix string) []string {
+		keys := make([]string, 0)
+		iter := d.db.NewIterator(&IteratorOptions{Prefix: []byte(prefix)})
+		defer iter.Close()
+		for ; iter.Valid(); iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		return keys
+	}
+	assert.Equal(t, []string{"k31", "k30", "k3"}, scan("k3"))
+	assert.Equal(t, []string{"k4", "k31", "k30", "k3", "k2", "k1"}, scan("k"))
+	assert.Empty(t, scan("k5"))
+}
+
+func TestDB_FullFilter(t *testing.T) {
+	db, err := Open(&Config{
+		FilterPolicy: sstable.NewBloomFilterPolicy(16),
+		FullFilter:   true,
+	})
+	assert.NoError(t, err)
+	d := &testDB{db: db, storage: db.storage, t: t}
+	d.pauseCompactGoroutine()
+
+	nRec := d.bulkPut(64 * KB)
+	d.memCompaction()
+
+	reader, err := d.storage.open(d.storage.level0[0])
+	assert.NoError(t, err)
+	defer reader.Unref()
+	assert.Equal(t, "lsm.BuiltinBloomFilter", reader.Properties().FilterPolicy)
+	assert.True(t, reader.Properties().FullFilter)
+
+	for i := 0; i < nRec; i++ {
+		key, val := getKV(i)
+		d.get(key, val)
+	}
+	d.get("nonexistent", "")
+}
+
+func TestDB_PrefixIterator(t *testing.T) {
+	// more bits per key to rule out false positive of the filter
+	db, err := Open(&Config{
+		PrefixExtractor: sstable.NewFixedPrefixExtractor(4),
+		FilterPolicy:    sstable.NewBloomFilterPolicy(20),
+	})
+	assert.NoError(t, err)
+	d := &testDB{db: db, storage: db.storage, t: t}
+	d.pauseCompactGoroutine()
+
+	// each table only contains keys of one tenant
+	for _, tenant := range []string{"t001", "t003", "t005"} {
+		for i := 0; i < 200; i++ {
+			d.put(fmt.Sprintf("%v-%05d", tenant, i), tenant)
+		}
+		d.memCompaction()
+	}
+	d.put("t003-00000", "replaced")
+
+	reader, err := d.storage.open(d.storage.level0[0])
+	assert.NoError(t, err)
+	defer reader.Unref()
+	assert.True(t, reader.MayContainPrefix([]byte("t001")))
+	assert.False(t, reader.MayContainPrefix([]byte("t003")))
+
+	scan := func(prefix string) (keys []string) {
+		iter := d.db.NewIterator(&IteratorOptions{Prefix: []byte(prefix)})
+		defer iter.Close()
+		for ; iter.Valid(); iter.Next() {
+			assert.Equal(t, prefix, string(iter.Key()[:4]))
+			keys = append(keys, string(iter.Key()))
+		}
+		return keys
+	}
+
+	keys := scan("t003")
+	assert.Len(t, keys, 200)
+	assert.Equal(t, "t003-00000", keys[0])
+	assert.Equal(t, "t003-00199", keys[199])
+	assert.Empty(t, scan("t002"))
+	assert.Empty(t, scan("t006"))
+
+	iter := d.db.NewIterator(&IteratorOptions{Prefix: []byte("t003")})
+	defer iter.Close()
+	assert.Equal(t, "replaced", string(iter.Value()))
+}
+
+func TestDB_TableMayContain(t *testing.T) {
+	d := newTestDB(t)
+	d.pauseCompactGoroutine()
+
+	nRec := d.bulkPut(256 * KB)
+	d.memCompaction()
+
+	reader, err := d.storage.open(d.storage.level0[0])
+	assert.NoError(t, err)
+	defer reader.Unref()
+	for i := 0; i < nRec; i++ {
+		key, _ := getKV(i)
+		assert.True(t, reader.MayContain([]byte(key)))
+	}
+
+	falsePositive := 0
+	for i := 0; i < nRec; i++ {
+		key, _ := getKV(i)
+		if reader.MayContain([]byte(key + "-absent")) {
+			falsePositive += 1
+		}
+	}
+	assert.Less(t, falsePositive, nRec/20)
+}
+
+func TestDB_PartitionedIndex(t *testing.T) {
+	db, err := Open(&Config{
+		PartitionedIndex: true,
+		PrefixExtractor:  sstable.NewFixedPrefixExtractor(6),
+	})
+	assert.NoError(t, err)
+	d := &testDB{db: db, storage: db.storage, t: t}
+	d.pauseCompactGoroutine()
+
+	nRec := d.bulkPut(1 * MB)
+	d.memCompaction()
+
+	reader, err := d.storage.open(d.storage.level0[0])
+	assert.NoError(t, err)
+	defer reader.Unref()
+	assert.True(t, reader.Properties().PartitionedIndex)
+
+	for i := 0; i < nRec; i++ {
+		key, val := getKV(i)
+		d.get(key, val)
+	}
+	d.get("nonexistent", "")
+
+	count := 0
+	iter := d.db.NewIterator(nil)
+	for ; iter.Valid(); iter.Next() {
+		key, val := getKV(count)
+		assert.Equal(t, key, string(iter.Key()))
+		assert.Equal(t, val, string(iter.Value()))
+		count += 1
+	}
+	iter.Close()
+	assert.Equal(t, nRec, count)
+
+	// keys are "%010d", prefix "000000" covers first 10000 keys
+	count = 0
+	iter = d.db.NewIterator(&IteratorOptions{Prefix: []byte("000000")})
+	for ; iter.Valid(); iter.Next() {
+		count += 1
+	}
+	iter.Close()
+	assert.Equal(t, 10000, count)
+	assert.False(t, reader.MayContainPrefix([]byte("999999")))
+}
+
+func TestDB_DataBlockHashIndex(t *testing.T) {
+	db, err := Open(&Config{DataBlockHashIndex: true})
+	assert.NoError(t, err)
+	d := &testDB{db: db, storage: db.storage, t: t}
+	d.pauseCompactGoroutine()
+
+	nRec := d.bulkPut(64 * KB)
+	d.put("0000000001", "replaced")
+	d.memCompaction()
+
+	reader, err := d.storage.open(d.storage.level0[0])
+	assert.NoError(t, err)
+	defer reader.Unref()
+	assert.True(t, reader.Properties().DataBlockHashIndex)
+
+	for i := 2; i < nRec; i++ {
+		key, val := getKV(i)
+		d.get(key, val)
+	}
+	d.get("0000000001", "replaced")
+	d.get("nonexistent", "")
+}
+
+func TestDB_Mmap(t *testing.T) {
+	db, err := Open(&Config{Mmap: true})
+	assert.NoError(t, err)
+	d := &testDB{db: db, storage: db.storage, t: t}
+	d.pauseCompactGoroutine()
+
+	nRec := d.bulkPut(256 * KB)
+	d.memCompaction()
+
+	for i := 0; i < nRec; i++ {
+		key, val := getKV(i)
+		d.get(key, val)
+	}
+	d.get("nonexistent", "")
+
+	// mapping is kept until iterator releases the table evicted from table cache
+	tb := d.storage.level0[0]
+	reader, err := d.storage.open(tb)
+	assert.NoError(t, err)
+	iter := d.db.NewIterator(nil)
+	d.storage.tableCache.Remove(tb.id)
+	count := 0
+	for ; iter.Valid(); iter.Next() {
+		key, val := getKV(count)
+		assert.Equal(t, key, string(iter.Key()))
+		assert.Equal(t, val, string(iter.Value()))
+		count += 1
+	}
+	assert.Equal(t, nRec, count)
+	iter.Close()
+
+	assert.True(t, reader.Ref())
+	reader.Unref()
+	reader.Unref()
+	assert.False(t, reader.Ref())
+	key, val := getKV(1)
+	d.get(key, val)
+}
+
+func TestDB_BlobValue(t *testing.T) {
+	db, err := Open(&Config{BlobValueThreshold: 64})
+	assert.NoError(t, err)
+	d := &testDB{db: db, storage: db.storage, t: t}
+	d.pauseCompactGoroutine()
+
+	nRec := d.bulkPut(256 * KB)
+	d.put("small", "inline")
+	d.memCompaction()
+	assert.Equal(t, 1, len(d.storage.blobFiles()))
+
+	for i := 0; i < nRec; i++ {
+		key, val := getKV(i)
+		d.get(key, val)
+	}
+	d.get("small", "inline")
+
+	checkIter := func(iter *DBIterator) {
+		count := 0
+		for ; iter.Valid(); iter.Next() {
+			if string(iter.Key()) == "small" {
+				assert.Equal(t, "inline", string(iter.Value()))
+			} else {
+				_, val := getKV(count)
+				assert.Equal(t, val, string(iter.Value()))
+			}
+			count += 1
+		}
+		assert.Equal(t, nRec+1, count)
+	}
+	iter := d.db.NewIterator(nil)
+	checkIter(iter)
+	iter.Close()
+
+	// overwrite most values, so the blob file is rewritten by garbage collection
+	iter = d.db.NewIterator(nil)
+	for i := 0; i < nRec*3/4; i++ {
+		key, _ := getKV(i)
+		d.put(key, "replaced")
+	}
+	old := d.storage.blobFiles()[0].id
+	assert.NoError(t, d.db.GarbageCollectBlobs())
+	assert.Equal(t, 1, len(d.storage.blobFiles()))
+	assert.NotEqual(t, old, d.storage.blobFiles()[0].id)
+
+	// old file is removed once iterator created before garbage collection is closed
+	_, err = os.Stat(fileName(BlobFile, old))
+	assert.NoError(t, err)
+	iter.First()
+	for i := 0; i < nRec*3/4; i++ {
+		iter.Next()
+	}
+	for i := nRec * 3 / 4; i < nRec; i++ {
+		_, val := getKV(i)
+		assert.Equal(t, val, string(iter.Value()))
+		iter.Next()
+	}
+	iter.Close()
+	_, err = os.Stat(fileName(BlobFile, old))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	for i := 0; i < nRec; i++ {
+		key, val := getKV(i)
+		if i < nRec*3/4 {
+			val = "replaced"
+		}
+		d.get(key, val)
+	}
+
+	d.memCompaction()
+	assert.NoError(t, d.reopen(&Config{BlobValueThreshold: 64}))
+	for i := nRec * 3 / 4; i < nRec; i++ {
+		key, val := getKV(i)
+		d.get(key, val)
+	}
+}
+
+func TestDB_BlobFilterShadowed(t *testing.T) {
+	db, err := Open(&Config{BlobValueThreshold: 64, CompactionFilter: valueFilter{}})
+	assert.NoError(t, err)
+	d := &testDB{db: db, storage: db.storage, t: t}
+	d.pauseCompactGoroutine()
+
+	nRec := d.bulkPut(4 * KB)
+	d.memCompaction()
+	// live values are rewritten into memtable twice, the first rewritten file is collected
+	// while memtable still has entries pointing to it
+	bounds := []int{0, 2 * nRec / 3, 7 * nRec / 8}
+	for round := 1; round < len(bounds); round++ {
+		for i := bounds[round-1]; i < bounds[round]; i++ {
+			key, _ := getKV(i)
+			d.put(key, "replaced")
+		}
+		assert.NoError(t, d.db.GarbageCollectBlobs())
+		assert.Len(t, d.storage.blobFiles(), 1)
+	}
+
+	// shadowed entries aren't read by compaction filter
+	d.memCompaction()
+	assert.NoError(t, d.db.flushError())
+	for i := 0; i < nRec; i++ {
+		key, val := getKV(i)
+		if i < bounds[2] {
+			val = "replaced"
+		}
+		d.get(key, val)
+	}
+}
+
+func TestDB_BlobGCInterval(t *testing.T) {
+	db, err := Open(&Config{BlobValueThreshold: 64, BlobGCInterval: 10 * time.Millisecond})
+	assert.NoError(t, err)
+	d := &testDB{db: db, storage: db.storage, t: t}
+	d.pauseCompactGoroutine()
+
+	nRec := d.bulkPut(64 * KB)
+	d.memCompaction()
+	assert.Equal(t, 1, len(d.storage.blobFiles()))
+	old := d.storage.blobFiles()[0].id
+
+	for i := 0; i < nRec; i++ {
+		key, _ := getKV(i)
+		d.put(key, "replaced")
+	}
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(fileName(BlobFile, old))
+		return errors.Is(err, fs.ErrNotExist)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, d.storage.blobFiles())
+
+	for i := 0; i < nRec; i++ {
+		key, _ := getKV(i)
+		d.get(key, "replaced")
+	}
+	// garbage collection is stopped once closed
+	d.db.Close()
+}
+
+func TestDB_IngestExternalFiles(t *testing.T) {
+	d := newTestDB(t)
+	dir := t.TempDir()
+
+	writeSST := func(name, prefix, val string, n int) string {
+		path := filepath.Join(dir, name)
+		w, err := NewSSTWriter(path, nil)
+		assert.NoError(t, err)
+		for i := 0; i < n; i++ {
+			assert.NoError(t, w.Put([]byte(fmt.Sprintf("%v-%05d", prefix, i)), []byte(val)))
+		}
+		assert.NoError(t, w.Finish())
+		return path
+	}
+
+	w, err := NewSSTWriter(filepath.Join(dir, "unsorted.sst"), nil)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Put([]byte("b"), nil))
+	assert.ErrorIs(t, w.Put([]byte("a"), nil), ErrKeysNotSorted)
+
+	// overlapping files are rejected
+	assert.Error(t, d.db.IngestExternalFiles([]string{
+		writeSST("x1.sst", "x", "x", 10),
+		writeSST("x2.sst", "x", "x", 20),
+	}, IngestOptions{}))
 
+	d.put("b-00000", "memtable")
+	d.put("c", "memtable")
+	fileA := writeSST("a.sst", "a", "ingested", 100)
+	fileB := writeSST("b.sst", "b", "ingested", 100)
+	assert.NoError(t, d.db.IngestExternalFiles([]string{fileA, fileB}, IngestOptions{MoveFiles: true}))
+
+	// a doesn't overlap anything, b overlaps the flushed memtable
+	d.assertLevelFilesNum(2)
+	assert.Equal(t, 1, d.storage.numTables(MaximumLevel))
+	// sequence 1 is taken by the flush
+	assert.Equal(t, uint64(2), d.storage.level0[1].seqNum)
+
+	for i := 0; i < 100; i++ {
+		d.get(fmt.Sprintf("a-%05d", i), "ingested")
+		d.get(fmt.Sprintf("b-%05d", i), "ingested")
+	}
+	d.get("c", "memtable")
+
+	count := 0
+	iter := d.db.NewIterator(nil)
+	for ; iter.Valid(); iter.Next() {
+		count += 1
+	}
+	iter.Close()
+	assert.Equal(t, 201, count)
+
+	r, err := NewSSTReader(d.storage.level0[1].getTableName(), nil)
+	assert.NoError(t, err)
+	val, err := r.Get([]byte("b-00001"))
+	assert.NoError(t, err)
+	assert.Equal(t, "ingested", string(val))
+	assert.NoError(t, r.Close())
+
+	assert.NoError(t, d.reopen(nil))
+	assert.Equal(t, uint64(2), d.storage.lastSequence)
+	d.get("a-00042", "ingested")
+	d.get("b-00000", "ingested")
+}
+
+func TestDB_ExportAndDump(t *testing.T) {
+	d := newTestDB(t)
+	d.pauseCompactGoroutine()
+
+	nRec := d.bulkPut(256 * KB)
+	d.memCompaction()
+	d.put("0000000010", "replaced")
+
+	dir := t.TempDir()
+	lower, _ := getKV(10)
+	upper, _ := getKV(nRec - 10)
+	paths, err := d.db.ExportRange([]byte(lower), []byte(upper), dir)
+	assert.NoError(t, err)
+	assert.Len(t, paths, 1)
+
+	var dump bytes.Buffer
+	assert.NoError(t, d.db.Dump(&dump))
+	d.db.Close()
+
+	// ingest exported range into a new database
+	d = newTestDB(t)
+	assert.NoError(t, d.db.IngestExternalFiles(paths, IngestOptions{}))
+	d.get("0000000010", "replaced")
+	for i := 11; i < nRec; i++ {
+		key, val := getKV(i)
+		if i >= nRec-10 {
+			val = ""
+		}
+		d.get(key, val)
+	}
+	d.get("0000000009", "")
+	d.db.Close()
+
+	d = newTestDB(t)
+	assert.NoError(t, d.db.Load(bytes.NewReader(dump.Bytes())))
 	for i := 0; i < nRec; i++ {
 		key, val := getKV(i)
+		if i == 10 {
+			val = "replaced"
+		}
 		d.get(key, val)
 	}
+
+	corrupted := append([]byte(nil), dump.Bytes()...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	assert.ErrorIs(t, d.db.Load(bytes.NewReader(corrupted)), ErrCorruptedDump)
+	assert.ErrorIs(t, d.db.Load(bytes.NewReader(dump.Bytes()[:dump.Len()-1])), ErrCorruptedDump)
+
+	// length of comparator name is read before checksum, it mustn't allocate that much
+	corrupted = append([]byte(nil), dump.Bytes()...)
+	corrupted[len(dumpMagic)] = 0xff
+	assert.ErrorIs(t, d.db.Load(bytes.NewReader(corrupted)), ErrCorruptedDump)
+	huge := binary.AppendUvarint([]byte(dumpMagic), math.MaxUint64)
+	assert.ErrorIs(t, d.db.Load(bytes.NewReader(huge)), ErrCorruptedDump)
+	huge = binary.AppendUvarint([]byte(dumpMagic), 1<<40)
+	assert.ErrorIs(t, d.db.Load(bytes.NewReader(huge)), ErrCorruptedDump)
+}
+
+func TestDB_ExportBlobError(t *testing.T) {
+	db, err := Open(&Config{BlobValueThreshold: 64})
+	assert.NoError(t, err)
+	d := &testDB{db: db, storage: db.storage, t: t}
+	d.pauseCompactGoroutine()
+
+	d.bulkPut(4 * KB)
+	d.memCompaction()
+	bf := d.storage.blobFiles()[0]
+	d.storage.blobCache.Remove(bf.id)
+	assert.NoError(t, os.Remove(fileName(BlobFile, bf.id)))
+
+	// values which can't be read aren't exported as empty
+	assert.ErrorIs(t, d.db.Dump(io.Discard), fs.ErrNotExist)
+	_, err = d.db.ExportRange(nil, nil, t.TempDir())
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestDB_ScanSnapshot(t *testing.T) {
+	d := newTestDB(t)
+	d.pauseCompactGoroutine()
+
+	nRec := 0
+	for i := 0; i < 2; i++ {
+		nRec += d.bulkPutFrom(64*KB, nRec)
+		d.memCompaction()
+	}
+	d.put("0000000000", "replaced")
+	level0 := append(tables{}, d.storage.level0...)
+
+	// writes and compaction go on during scan, scan sees neither of them
+	count := 0
+	err := d.db.scanSnapshot(nil, nil, func(key, val []byte) error {
+		if count == 0 {
+			assert.Equal(t, "replaced", string(val))
+			assert.NoError(t, d.db.Delete([]byte("0000000001")))
+			d.put("0000000002", "new")
+			d.memCompaction()
+			compact := &compaction{level: 0, outputLevel: 1}
+			for i := len(d.storage.level0) - 1; i >= 0; i-- {
+				compact.inputs = append(compact.inputs, tables{d.storage.level0[i]})
+			}
+			d.db.majorCompaction(compact)
+			d.assertLevelFilesNum(0, 1)
+			_, err := os.Stat(level0[0].getTableName())
+			assert.NoError(t, err)
+		} else {
+			_, expect := getKV(count)
+			assert.Equal(t, expect, string(val))
+		}
+		count += 1
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, nRec, count)
+
+	// compacted tables are removed once scan is done
+	for _, tb := range level0 {
+		_, err := os.Stat(tb.getTableName())
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+	}
+	d.get("0000000001", "")
+	d.get("0000000002", "new")
+}
+
+func TestDB_CompactPointer(t *testing.T) {
+	d := newTestDB(t)
+	d.pauseCompactGoroutine()
+
+	newTable := func(id uint64, minKey, maxKey string) *table {
+		return &table{id: id, size: 1 << 40, minKey: []byte(minKey), maxKey: []byte(maxKey)}
+	}
+	d.storage.levels[0] = tables{newTable(1, "a", "c"), newTable(2, "d", "f"), newTable(3, "g", "i")}
+	d.storage.levels[1] = tables{newTable(4, "b", "e")}
+	d.storage.levels[2] = tables{newTable(5, "a", "a"), newTable(6, "c", "c"), newTable(7, "z", "z")}
+
+	// pointer isn't moved by compaction which isn't applied, e.g. failed one
+	comp := d.storage.pickCompaction()
+	assert.Equal(t, uint64(1), comp.inputs[0][0].id)
+	d.storage.releaseCompaction(comp)
+
+	// level 1 is compacted in turn, and wraps around after the last table
+	for _, id := range []uint64{1, 2, 3, 1} {
+		comp := d.storage.pickCompaction()
+		assert.Equal(t, 1, comp.level)
+		assert.Equal(t, id, comp.inputs[0][0].id)
+		assert.Equal(t, comp.inputs[0][0].maxKey, comp.compactPointer)
+		d.storage.releaseCompaction(comp)
+		// as if it's applied
+		d.storage.compactPointers[comp.level] = comp.compactPointer
+	}
+
+	comp = d.storage.pickCompaction()
+	assert.Equal(t, uint64(2), comp.inputs[0][0].id)
+	assert.Equal(t, uint64(4), comp.inputs[1][0].id)
+	// grandparents overlap the whole range of inputs
+	assert.Len(t, comp.grandparents, 1)
+	assert.Equal(t, uint64(6), comp.grandparents[0].id)
+
+	// tables being compacted are skipped
+	comp = d.storage.pickCompaction()
+	assert.Equal(t, uint64(3), comp.inputs[0][0].id)
+	comp = d.storage.pickCompaction()
+	assert.Equal(t, 3, comp.level)
+	assert.Equal(t, uint64(5), comp.inputs[0][0].id)
+
+	d.storage.mu.Lock()
+	assert.NoError(t, d.storage.saveManifest())
+	d.storage.mu.Unlock()
+	m, err := readManifest()
+	assert.NoError(t, err)
+	// running compactions aren't applied yet
+	assert.Equal(t, "c", string(m.compactPointers[1]))
+}
+
+func TestDB_TrivialMove(t *testing.T) {
+	d := newTestDB(t)
+	d.pauseCompactGoroutine()
+
+	nRec := d.bulkPut(64 * KB)
+	d.memCompaction()
+	t0 := d.storage.level0[0]
+
+	// no overlap in level 1, table is moved as is
+	d.db.majorCompaction(&compaction{level: 0, outputLevel: 1, inputs: []tables{{t0}}})
+	d.assertLevelFilesNum(0, 1)
+	assert.Same(t, t0, d.storage.levels[0][0])
+	_, err := os.Stat(t0.getTableName())
+	assert.NoError(t, err)
+
+	// too many grandparent tables overlap, table is rewritten
+	gp := &table{id: 1 << 30, size: uint64(GrandparentOverlapFactor*FileSize) + 1, minKey: t0.minKey, maxKey: t0.maxKey}
+	d.db.majorCompaction(&compaction{level: 1, outputLevel: 2, inputs: []tables{{t0}}, grandparents: tables{gp}})
+	d.assertLevelFilesNum(0, 0, 1)
+	assert.NotEqual(t, t0.id, d.storage.levels[1][0].id)
+
+	for i := 0; i < nRec; i++ {
+		key, val := getKV(i)
+		d.get(key, val)
+	}
+}
+
+// blockingFilter blocks compactions into level 2 until released, and reports the range of
+// each blocked compaction once
+type blockingFilter struct {
+	started chan string
+	release chan struct{}
+	seen    sync.Map
+}
+
+func (f *blockingFilter) Filter(level int, key, value []byte) (FilterDecision, []byte) {
+	if level != 2 {
+		return FilterKeep, nil
+	}
+	name := "low"
+	if string(key) >= "0000001000" {
+		name = "high"
+	}
+	if _, loaded := f.seen.LoadOrStore(name, true); !loaded {
+		f.started <- name
+	}
+	<-f.release
+	return FilterKeep, nil
+}
+
+func TestDB_ConcurrentCompaction(t *testing.T) {
+	defer func(size, multiplier int) { Level1FilesSize, SizeMultiplier = size, multiplier }(Level1FilesSize, SizeMultiplier)
+	// level 1 always needs compaction, level 2 never does
+	Level1FilesSize = 1
+	SizeMultiplier = 1 << 30
+
+	filter := &blockingFilter{started: make(chan string, 2), release: make(chan struct{})}
+	db, err := Open(&Config{CompactionFilter: filter})
+	assert.NoError(t, err)
+	d := &testDB{db: db, storage: db.storage, t: t}
+	d.pauseCompactGoroutine()
+
+	// two disjoint ranges in level 1, each overlapping its own table in level 2
+	for _, outputLevel := range []int{2, 1} {
+		for _, from := range []int{0, 1000} {
+			d.bulkPutFrom(10*KB, from)
+			d.memCompaction()
+			d.storage.moveTable(d.storage.level0[0], 0, outputLevel, nil)
+		}
+	}
+	d.assertLevelFilesNum(0, 2, 2)
+
+	// resume, both workers pick a compaction of level 1
+	d.pauseCompactGoroutine()
+	for d.db.paused.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	d.db.signalWorkers()
+	started := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case name := <-filter.started:
+			started[name] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("compactions don't run concurrently")
+		}
+	}
+	assert.Len(t, started, 2)
+
+	// flush isn't blocked by running compactions
+	nRec := d.bulkPutFrom(10*KB, 2000)
+	flushed := make(chan struct{})
+	go func() {
+		d.db.flushMemTable()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flush is blocked by compaction")
+	}
+	d.assertLevelFilesNum(1)
+
+	close(filter.release)
+	d.stopCompaction()
+	for _, from := range []int{0, 1000, 2000} {
+		for i := from; i < from+nRec; i++ {
+			key, val := getKV(i)
+			d.get(key, val)
+		}
+	}
+}
+
+func TestDB_Subcompaction(t *testing.T) {
+	defer func(size int) { FileSize = size }(FileSize)
+	FileSize = 16 * KB
+
+	d := newTestDB(t)
+	d.pauseCompactGoroutine()
+
+	// tables of disjoint ranges, and a newer table overwriting part of them
+	nRec := 0
+	for i := 0; i < 4; i++ {
+		nRec += d.bulkPutFrom(32*KB, nRec)
+		d.memCompaction()
+	}
+	for i := 0; i < nRec; i += 7 {
+		key, _ := getKV(i)
+		d.put(key, "new")
+	}
+	d.memCompaction()
+
+	compact := &compaction{level: 0, outputLevel: 1}
+	for i := len(d.storage.level0) - 1; i >= 0; i-- {
+		compact.inputs = append(compact.inputs, tables{d.storage.level0[i]})
+	}
+	assert.Len(t, d.db.subcompactionBounds(compact), 3)
+
+	d.db.majorCompaction(compact)
+	d.assertLevelFilesNum(0)
+	level1 := d.storage.levels[0]
+	assert.NotEmpty(t, level1)
+	for i := 1; i < len(level1); i++ {
+		assert.Less(t, string(level1[i-1].maxKey), string(level1[i].minKey))
+	}
+
+	for i := 0; i < nRec; i++ {
+		key, val := getKV(i)
+		if i%7 == 0 {
+			val = "new"
+		}
+		d.get(key, val)
+	}
+}
+
+type testCompactionFilter struct {
+	levels sync.Map
+	stop   []byte
+}
+
+// drop keys ending with 1, rewrite keys ending with 2
+func (f *testCompactionFilter) Filter(level int, key, value []byte) (FilterDecision, []byte) {
+	f.levels.Store(level, true)
+	if bytes.Equal(key, f.stop) {
+		return FilterStop, nil
+	}
+	switch key[len(key)-1] {
+	case '1':
+		return FilterRemove, nil
+	case '2':
+		if !bytes.HasPrefix(value, []byte("changed-")) {
+			return FilterChangeValue, append([]byte("changed-"), value...)
+		}
+	}
+	return FilterKeep, nil
+}
+
+func TestDB_CompactionFilter(t *testing.T) {
+	filter := &testCompactionFilter{}
+	db, err := Open(&Config{CompactionFilter: filter, BlobValueThreshold: 50})
+	assert.NoError(t, err)
+	d := &testDB{db: db, storage: db.storage, t: t}
+	d.pauseCompactGoroutine()
+
+	// 41 keys, filter stops at the last key
+	nRec := d.bulkPut(4 * KB)
+	last, _ := getKV(nRec - 1)
+	filter.stop = []byte(last)
+	extra, extraVal := getKV(1001)
+	d.put(extra, extraVal)
+	d.memCompaction()
+	_, ok := filter.levels.Load(0)
+	assert.True(t, ok)
+	stats := d.db.CompactionFilterStats()
+	assert.Equal(t, CompactionFilterStats{Kept: 32, Removed: 4, Changed: 4, Stopped: 1}, stats)
+
+	// same keys again, so tables are merged instead of moved
+	d.bulkPut(4 * KB)
+	d.memCompaction()
+	compact := &compaction{level: 0, outputLevel: 1}
+	for i := len(d.storage.level0) - 1; i >= 0; i-- {
+		compact.inputs = append(compact.inputs, tables{d.storage.level0[i]})
+	}
+	d.db.majorCompaction(compact)
+	d.assertLevelFilesNum(0, 1)
+	_, ok = filter.levels.Load(1)
+	assert.True(t, ok)
+
+	for i := 0; i < nRec; i++ {
+		key, val := getKV(i)
+		switch i % 10 {
+		case 1:
+			val = ""
+		case 2:
+			val = "changed-" + val
+		}
+		d.get(key, val)
+	}
+	// entry after stop isn't filtered
+	d.get(extra, extraVal)
+	stats = d.db.CompactionFilterStats()
+	assert.Equal(t, CompactionFilterStats{Kept: 32 + 32 + 36, Removed: 8, Changed: 8, Stopped: 3}, stats)
+}
+
+// valueFilter removes entries with value "drop"
+type valueFilter struct{}
+
+func (valueFilter) Filter(level int, key, value []byte) (FilterDecision, []byte) {
+	if string(value) == "drop" {
+		return FilterRemove, nil
+	}
+	return FilterKeep, nil
+}
+
+func TestDB_CompactionFilterTombstone(t *testing.T) {
+	db, err := Open(&Config{CompactionFilter: valueFilter{}})
+	assert.NoError(t, err)
+	d := &testDB{db: db, storage: db.storage, t: t}
+	d.pauseCompactGoroutine()
+
+	d.put("k1", "old")
+	d.put("k2", "v2")
+	d.memCompaction()
+	d.storage.moveTable(d.storage.level0[0], 0, 2, nil)
+
+	// older version in level 2 stays deleted
+	d.put("k1", "drop")
+	d.memCompaction()
+	d.get("k1", "")
+	compact := &compaction{level: 0, outputLevel: 1, inputs: []tables{{d.storage.level0[0]}}}
+	d.db.majorCompaction(compact)
+	d.assertLevelFilesNum(0, 1, 1)
+	d.get("k1", "")
+
+	// tombstone is dropped in the bottommost level
+	compact = &compaction{level: 1, outputLevel: 2, inputs: []tables{d.storage.levels[0], d.storage.levels[1]}}
+	d.db.majorCompaction(compact)
+	d.assertLevelFilesNum(0, 0, 1)
+	d.get("k1", "")
+	d.get("k2", "v2")
+	assert.Zero(t, d.storage.tableProps(d.storage.levels[1][0]).numDeletions)
+}
+
+func TestDB_FlushError(t *testing.T) {
+	db, err := Open(&Config{CompactionFilter: valueFilter{}})
+	assert.NoError(t, err)
+	d := &testDB{db: db, storage: db.storage, t: t}
+
+	// value of unknown kind fails compaction filter
+	d.db.mtable.Put([]byte("k1"), []byte{0xff})
+	assert.Error(t, d.db.flushMemTable())
+	assert.Error(t, d.db.Put([]byte("k2"), []byte("v2")))
+	assert.Error(t, d.db.Delete([]byte("k2")))
+	assert.Error(t, d.db.DeleteRange([]byte("k1"), []byte("k3")))
+}
+
+func TestDB_RateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(256 * KB)
+	db, err := Open(&Config{RateLimiter: limiter})
+	assert.NoError(t, err)
+	d := &testDB{db: db, storage: db.storage, t: t}
+	d.pauseCompactGoroutine()
+
+	// burst of 25.6 KB is written at once, the rest takes at least 150ms
+	nRec := d.bulkPut(64 * KB)
+	start := time.Now()
+	d.memCompaction()
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+
+	// waiting writes follow the changed limit
+	limiter.SetBytesPerSecond(1)
+	done := make(chan struct{})
+	go func() {
+		limiter.request(MB, ioPriorityLow)
+		limiter.request(MB, ioPriorityLow)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	limiter.SetBytesPerSecond(0)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("request isn't unblocked by removed limit")
+	}
+
+	for i := 0; i < nRec; i++ {
+		key, val := getKV(i)
+		d.get(key, val)
+	}
+}
+
+func TestDB_RateLimiterBlob(t *testing.T) {
+	limiter := NewRateLimiter(256 * KB)
+	db, err := Open(&Config{RateLimiter: limiter, BlobValueThreshold: 64})
+	assert.NoError(t, err)
+	d := &testDB{db: db, storage: db.storage, t: t}
+	d.pauseCompactGoroutine()
+
+	// values are written to blob file, which is charged like sstable
+	nRec := d.bulkPut(64 * KB)
+	start := time.Now()
+	d.memCompaction()
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+	assert.Len(t, d.storage.blobFiles(), 1)
+
+	// so is the blob file rewritten by garbage collection
+	for i := 0; i < nRec/4*3; i++ {
+		key, _ := getKV(i)
+		d.put(key, "replaced")
+	}
+	limiter.SetBytesPerSecond(16 * KB)
+	start = time.Now()
+	assert.NoError(t, d.db.GarbageCollectBlobs())
+	assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+
+	for i := nRec / 4 * 3; i < nRec; i++ {
+		key, val := getKV(i)
+		d.get(key, val)
+	}
+}
+
+func TestDB_DynamicLevelBytes(t *testing.T) {
+	defer func(size, multiplier int) {
+		Level1FilesSize, SizeMultiplier = size, multiplier
+	}(Level1FilesSize, SizeMultiplier)
+	Level1FilesSize, SizeMultiplier = 4*KB, 4
+
+	policy := &LeveledCompactionPolicy{DynamicLevelBytes: true}
+	db, err := Open(&Config{CompactionPolicy: policy})
+	assert.NoError(t, err)
+	d := &testDB{db: db, storage: db.storage, t: t}
+	d.pauseCompactGoroutine()
+
+	// level 0 is compacted into the last level while it's small
+	nRec := 0
+	for i := 0; i <= Level0FileNumber; i++ {
+		nRec += d.bulkPutFrom(KB, nRec)
+		d.memCompaction()
+	}
+	d.db.compactPending()
+	last := len(d.storage.levels)
+	for level := 0; level < last; level++ {
+		assert.Zero(t, d.storage.numTables(level))
+	}
+	assert.NotEmpty(t, d.storage.levels[last-1])
+
+	// base level moves up as the last level grows
+	for i := 0; i < 10*(Level0FileNumber+1); i++ {
+		nRec += d.bulkPutFrom(2*KB, nRec)
+		d.memCompaction()
+		d.db.compactPending()
+	}
+	targets, base := policy.levelTargets(d.storage)
+	assert.Less(t, base, last)
+	assert.Equal(t, d.storage.levelSize(last), targets[last])
+	for level := 1; level < last; level++ {
+		if level < base {
+			assert.Zero(t, d.storage.numTables(level))
+		} else {
+			assert.LessOrEqual(t, d.storage.levelSize(level), targets[level])
+		}
+	}
+
+	for i := 0; i < nRec; i++ {
+		key, val := getKV(i)
+		d.get(key, val)
+	}
+}
+
+func TestDB_SeekCompaction(t *testing.T) {
+	defer func(seeks, period int) {
+		MinAllowedSeeks, ReadBytesPeriod = seeks, period
+	}(MinAllowedSeeks, ReadBytesPeriod)
+	MinAllowedSeeks = 10
+
+	d := newTestDB(t)
+	d.pauseCompactGoroutine()
+
+	// table of level 1 covers keys of level 2 but holds only the first and last ones
+	nRec := d.bulkPut(4 * KB)
+	d.memCompaction()
+	t0 := d.storage.level0[0]
+	d.db.majorCompaction(&compaction{level: 0, outputLevel: 1, inputs: []tables{{t0}}})
+	d.db.majorCompaction(&compaction{level: 1, outputLevel: 2, inputs: []tables{{t0}}})
+	first, _ := getKV(0)
+	last, _ := getKV(nRec - 1)
+	newL1 := func() *table {
+		d.put(first, "first")
+		d.put(last, "last")
+		d.memCompaction()
+		t1 := d.storage.level0[0]
+		d.db.majorCompaction(&compaction{level: 0, outputLevel: 1, inputs: []tables{{t1}}})
+		return t1
+	}
+
+	t1 := newL1()
+	key, val := getKV(1)
+	for i := 0; i < MinAllowedSeeks; i++ {
+		assert.Nil(t, d.storage.seekCompact)
+		d.get(key, val)
+	}
+	assert.Same(t, t1, d.storage.seekCompact)
+	assert.Equal(t, 1, d.storage.seekCompactLevel)
+
+	compact := d.storage.pickCompaction()
+	assert.Equal(t, 1, compact.level)
+	assert.Equal(t, []tables{{t1}, {t0}}, compact.inputs)
+	d.db.majorCompaction(compact)
+	d.storage.releaseCompaction(compact)
+	assert.Nil(t, d.storage.seekCompact)
+	d.assertLevelFilesNum(0, 0, 1)
+
+	// keys read by iterator are sampled
+	ReadBytesPeriod = 1
+	t1 = newL1()
+	iter := d.db.NewIterator(nil)
+	defer iter.Close()
+	for i := 0; i < MinAllowedSeeks && iter.Valid(); i++ {
+		iter.Next()
+	}
+	assert.Same(t, t1, d.storage.seekCompact)
+
+	d.get(first, "first")
+	d.get(last, "last")
+	for i := 1; i < nRec-1; i++ {
+		key, val := getKV(i)
+		d.get(key, val)
+	}
+}
+
+func TestDB_TTLAndPeriodicCompaction(t *testing.T) {
+	policy := &LeveledCompactionPolicy{TTL: time.Hour}
+	db, err := Open(&Config{CompactionPolicy: policy})
+	assert.NoError(t, err)
+	d := &testDB{db: db, storage: db.storage, t: t}
+	d.pauseCompactGoroutine()
+
+	nRec := d.bulkPut(4 * KB)
+	d.memCompaction()
+	t0 := d.storage.level0[0]
+	d.db.compactPending()
+	d.assertLevelFilesNum(1)
+
+	// trivially moved tables keep their creation time, old table reaches the last level
+	// in one pass instead of one level per TTL
+	createdAt := time.Now().Add(-2 * time.Hour).Unix()
+	t0.createdAt = createdAt
+	d.db.compactPending()
+	last := len(d.storage.levels)
+	for level := 0; level < last; level++ {
+		assert.Zero(t, d.storage.numTables(level))
+	}
+	assert.Equal(t, tables{t0}, d.storage.levels[last-1])
+	assert.Equal(t, createdAt, t0.createdAt)
+
+	// tables of the last level are rewritten in place
+	policy.TTL, policy.PeriodicCompaction = 0, time.Hour
+	d.db.compactPending()
+	assert.Len(t, d.storage.levels[last-1], 1)
+	assert.NotEqual(t, t0.id, d.storage.levels[last-1][0].id)
+	_, err = os.Stat(t0.getTableName())
+	assert.True(t, os.IsNotExist(err))
+
+	for i := 0; i < nRec; i++ {
+		key, val := getKV(i)
+		d.get(key, val)
+	}
+}
+
+func TestDB_CompactionPriority(t *testing.T) {
+	d := newTestDB(t)
+	d.pauseCompactGoroutine()
+
+	// properties are gathered by flush and read from table after reopen
+	nRec := d.bulkPut(4 * KB)
+	d.memCompaction()
+	assert.NoError(t, d.reopen(nil))
+	d.pauseCompactGoroutine()
+	props := d.storage.tableProps(d.storage.level0[0])
+	assert.Equal(t, uint64(nRec), props.numEntries)
+	assert.Equal(t, uint64(1), props.largestSeq)
+	assert.Zero(t, props.numDeletions)
+
+	newTable := func(id, size uint64, minKey, maxKey string, props tableProps) *table {
+		t := &table{id: id, size: size, minKey: []byte(minKey), maxKey: []byte(maxKey)}
+		t.props.Store(&props)
+		return t
+	}
+	// table 1 has many tombstones, table 2 has the least overlap, table 3 is the oldest
+	d.storage.levels[0] = tables{
+		newTable(1, 100, "a", "c", tableProps{numEntries: 10, rawValueSize: 100, numDeletions: 5, largestSeq: 3}),
+		newTable(2, 100, "d", "f", tableProps{numEntries: 10, rawValueSize: 100, largestSeq: 2}),
+		newTable(3, 100, "g", "i", tableProps{numEntries: 10, rawValueSize: 100, largestSeq: 1}),
+	}
+	d.storage.levels[1] = tables{
+		newTable(4, 1000, "a", "a", tableProps{}),
+		newTable(5, 50, "d", "d", tableProps{}),
+		newTable(6, 500, "g", "g", tableProps{}),
+	}
+	assert.Equal(t, uint64(200), d.storage.compensatedSize(d.storage.levels[0][0]))
+
+	for priority, id := range map[CompactionPriority]uint64{
+		PriorityRoundRobin:             1,
+		PriorityMinOverlappingRatio:    2,
+		PriorityOldestLargestSeqFirst:  3,
+		PriorityLargestCompensatedSize: 1,
+	} {
+		policy := &LeveledCompactionPolicy{Priority: priority}
+		comp := policy.pickLevel(d.storage, 1, 2, nil)
+		assert.Equal(t, id, comp.inputs[0][0].id, "priority %v", priority)
+		d.storage.compactPointers[1] = nil
+	}
+}
+
+func TestDB_UniversalCompaction(t *testing.T) {
+	policy := NewUniversalCompactionPolicy()
+	policy.MaxSortedRuns = 3
+	db, err := Open(&Config{CompactionPolicy: policy})
+	assert.NoError(t, err)
+	d := &testDB{db: db, storage: db.storage, t: t}
+	d.pauseCompactGoroutine()
+
+	compact := func() {
+		for c := d.storage.pickCompaction(); c != nil; c = d.storage.pickCompaction() {
+			d.db.majorCompaction(c)
+			d.storage.releaseCompaction(c)
+		}
+	}
+
+	// runs of the same keys, newer and older runs are equally large
+	nRec := 0
+	for i := 0; i < 4; i++ {
+		nRec = d.bulkPut(64 * KB)
+		d.put("version", fmt.Sprint(i))
+		d.memCompaction()
+	}
+	compact()
+	// all runs are merged into the last level for space amplification
+	d.assertLevelFilesNum(0)
+	assert.NotEmpty(t, d.storage.levels[MaximumLevel-1])
+	d.get("version", "3")
+
+	// small runs of similar size are merged, and the large run is left
+	for i := 0; i < 4; i++ {
+		d.bulkPut(4 * KB)
+		d.memCompaction()
+	}
+	bottom := d.storage.levels[MaximumLevel-1]
+	compact()
+	d.assertLevelFilesNum(0)
+	assert.NotEmpty(t, d.storage.levels[MaximumLevel-2])
+	assert.Equal(t, bottom, d.storage.levels[MaximumLevel-1])
+
+	for i := 0; i < nRec; i++ {
+		key, val := getKV(i)
+		d.get(key, val)
+	}
+	d.get("version", "3")
+}
+
+func TestDB_FIFOCompaction(t *testing.T) {
+	policy := NewFIFOCompactionPolicy(0, 0)
+	db, err := Open(&Config{CompactionPolicy: policy})
+	assert.NoError(t, err)
+	d := &testDB{db: db, storage: db.storage, t: t}
+	d.pauseCompactGoroutine()
+
+	nRec := 0
+	for i := 0; i < 5; i++ {
+		nRec += d.bulkPutFrom(16*KB, nRec)
+		d.memCompaction()
+	}
+	level0 := append(tables{}, d.storage.level0...)
+
+	// keep the newest 3 tables
+	policy.MaxTableFilesSize = level0[2].size + level0[3].size + level0[4].size
+	d.db.compactPending()
+	assert.Equal(t, level0[2:], tables(d.storage.level0))
+	_, err = os.Stat(level0[0].getTableName())
+	assert.True(t, os.IsNotExist(err))
+
+	first, _ := getKV(0)
+	d.get(first, "")
+	last, val := getKV(nRec - 1)
+	d.get(last, val)
+
+	policy.TTL = time.Hour
+	d.storage.level0[0].createdAt = time.Now().Add(-2 * time.Hour).Unix()
+	d.db.compactPending()
+	assert.Equal(t, level0[3:], tables(d.storage.level0))
+	d.get(last, val)
+}
+
+// level0Policy merges all tables of level 0 into level 1 through the exported view only
+type level0Policy struct {
+	// skip overlapping tables of level 1, compaction is rejected then
+	skipOverlap bool
+}
+
+func (p *level0Policy) CompactionLevel(v *LevelsView) int {
+	if p.PickCompaction(v) != nil {
+		return 0
+	}
+	return -1
+}
+
+func (p *level0Policy) PickCompaction(v *LevelsView) *Compaction {
+	level0 := v.Tables(0)
+	if len(level0) < 2 {
+		return nil
+	}
+	comp := &Compaction{Level: 0, OutputLevel: 1}
+	minKey, maxKey := level0[0].MinKey, level0[0].MaxKey
+	for i := len(level0) - 1; i >= 0; i-- {
+		if level0[i].Compacting {
+			return nil
+		}
+		comp.Inputs = append(comp.Inputs, level0[i:i+1])
+		if v.Compare(level0[i].MinKey, minKey) < 0 {
+			minKey = level0[i].MinKey
+		}
+		if v.Compare(level0[i].MaxKey, maxKey) > 0 {
+			maxKey = level0[i].MaxKey
+		}
+	}
+	if overlap := v.Overlaps(1, minKey, maxKey); len(overlap) > 0 && !p.skipOverlap {
+		comp.Inputs = append(comp.Inputs, overlap)
+	}
+	return comp
+}
+
+func TestDB_CustomCompactionPolicy(t *testing.T) {
+	policy := &level0Policy{}
+	db, err := Open(&Config{CompactionPolicy: policy})
+	assert.NoError(t, err)
+	d := &testDB{db: db, storage: db.storage, t: t}
+	d.pauseCompactGoroutine()
+
+	nRec := 0
+	for i := 0; i < 2; i++ {
+		nRec += d.bulkPutFrom(16*KB, nRec)
+		d.memCompaction()
+	}
+	d.db.compactPending()
+	d.assertLevelFilesNum(0, 1)
+	assert.Equal(t, d.storage.levelSize(1), (&LevelsView{d.storage}).LevelSize(1))
+
+	// compaction missing overlapping table of level 1 is rejected
+	policy.skipOverlap = true
+	d.put("0000000000", "replaced")
+	d.memCompaction()
+	d.put("0000000001", "replaced")
+	d.memCompaction()
+	d.db.compactPending()
+	d.assertLevelFilesNum(2, 1)
+
+	policy.skipOverlap = false
+	d.db.compactPending()
+	d.assertLevelFilesNum(0, 1)
+	d.get("0000000000", "replaced")
+	d.get("0000000001", "replaced")
+	for i := 2; i < nRec; i++ {
+		key, val := getKV(i)
+		d.get(key, val)
+	}
+}
+
+func TestDB_CompactRange(t *testing.T) {
+	d := newTestDB(t)
+
+	nRec := 0
+	for i := 0; i < 3; i++ {
+		nRec += d.bulkPutFrom(64*KB, nRec)
+		d.db.flushMemTable()
+	}
+	d.put("0000000000", "replaced")
+
+	// only the first table and memtable overlap the range
+	end, _ := getKV(10)
+	assert.NoError(t, d.db.CompactRange(nil, []byte(end), nil))
+	d.assertLevelFilesNum(2, 1)
+
+	assert.NoError(t, d.db.CompactRange(nil, nil, nil))
+	d.assertLevelFilesNum(0)
+	bottom := d.storage.bottommostLevel()
+	ids := make(map[uint64]bool)
+	for _, tb := range d.storage.levels[bottom-1] {
+		ids[tb.id] = true
+	}
+
+	assert.NoError(t, d.db.CompactRange(nil, nil, &CompactRangeOptions{ForceBottommost: true}))
+	assert.Equal(t, bottom, d.storage.bottommostLevel())
+	for _, tb := range d.storage.levels[bottom-1] {
+		assert.False(t, ids[tb.id])
+	}
+
+	d.get("0000000000", "replaced")
+	for i := 1; i < nRec; i++ {
+		key, val := getKV(i)
+		d.get(key, val)
+	}
+	// no flush is left running into the next test
+	d.stopCompaction()
+}
+
+func TestDB_CompactRangeBaseLevel(t *testing.T) {
+	policy := &LeveledCompactionPolicy{DynamicLevelBytes: true}
+	db, err := Open(&Config{CompactionPolicy: policy})
+	assert.NoError(t, err)
+	d := &testDB{db: db, storage: db.storage, t: t}
+	d.pauseCompactGoroutine()
+
+	// same keys twice, so tables are merged instead of moved
+	nRec := d.bulkPut(4 * KB)
+	d.memCompaction()
+	d.bulkPut(4 * KB)
+	d.memCompaction()
+
+	// level 0 is compacted into base level, which is the last level while it's empty
+	_, base := policy.levelTargets(d.storage)
+	last := len(d.storage.levels)
+	assert.Equal(t, last, base)
+	assert.NoError(t, d.db.CompactRange(nil, nil, nil))
+	for level := 0; level < last; level++ {
+		assert.Zero(t, d.storage.numTables(level))
+	}
+	assert.NotEmpty(t, d.storage.levels[last-1])
+
+	for i := 0; i < nRec; i++ {
+		key, val := getKV(i)
+		d.get(key, val)
+	}
+}
+
+func TestDB_CompactRangeError(t *testing.T) {
+	d := newTestDB(t)
+	d.pauseCompactGoroutine()
+
+	d.bulkPut(4 * KB)
+	d.memCompaction()
+	d.bulkPut(4 * KB)
+	d.memCompaction()
+
+	// input table can't be read
+	lost := d.storage.level0[0]
+	d.storage.tableCache.Remove(lost.id)
+	assert.NoError(t, os.Remove(lost.getTableName()))
+
+	assert.ErrorIs(t, d.db.CompactRange(nil, nil, nil), fs.ErrNotExist)
+	d.assertLevelFilesNum(2, 0)
+	// neither output table is left nor the lost table is recreated by reading it
+	entries, err := os.ReadDir(DirectoryPath)
+	assert.NoError(t, err)
+	for _, e := range entries {
+		if ftype, id, ok := parseFileName(e.Name()); ok && ftype == SstableFile {
+			assert.Equal(t, d.storage.level0[1].id, id)
+		}
+	}
+}
+
+func TestDB_DeleteRange(t *testing.T) {
+	defer func(size, factor int) { FileSize, GrandparentOverlapFactor = size, factor }(FileSize, GrandparentOverlapFactor)
+	FileSize = 16 * KB
+	GrandparentOverlapFactor = 2
+
+	d := newTestDB(t)
+	d.pauseCompactGoroutine()
+
+	nRec := 0
+	for i := 0; i < 3; i++ {
+		nRec += d.bulkPutFrom(64*KB, nRec)
+		d.memCompaction()
+	}
+	compact := &compaction{level: 0, outputLevel: 1}
+	for i := len(d.storage.level0) - 1; i >= 0; i-- {
+		compact.inputs = append(compact.inputs, tables{d.storage.level0[i]})
+	}
+	d.db.majorCompaction(compact)
+	d.db.majorCompaction(&compaction{level: 1, outputLevel: 2, inputs: []tables{d.storage.levels[0]}})
+	d.assertLevelFilesNum(0, 0)
+	nRec += d.bulkPutFrom(16*KB, nRec)
+	d.memCompaction()
+
+	start, _ := getKV(100)
+	end, _ := getKV(2000)
+	d.db.DeleteRange([]byte(start), []byte(end))
+	deleted, _ := getKV(50)
+	d.db.Delete([]byte(deleted))
+	// puts after range deletion are visible
+	d.bulkPutFrom(200*100, 1000)
+
+	check := func() {
+		for i := 0; i < nRec; i++ {
+			key, val := getKV(i)
+			if (i >= 100 && i < 2000 && (i < 1000 || i >= 1200)) || i == 50 {
+				val = ""
+			}
+			d.get(key, val)
+		}
+
+		iter := d.db.NewIterator(nil)
+		defer iter.Close()
+		n := 0
+		for ; iter.Valid(); iter.Next() {
+			n++
+		}
+		assert.Equal(t, nRec-1701, n)
+
+		iter.Seek([]byte(start))
+		key, _ := getKV(1000)
+		assert.Equal(t, key, string(iter.Key()))
+		key, _ = getKV(1199)
+		iter.Seek([]byte(key))
+		iter.Next()
+		assert.Equal(t, end, string(iter.Key()))
+	}
+	check()
+
+	// recovered from journal
+	assert.NoError(t, d.reopen(nil))
+	d.pauseCompactGoroutine()
+	check()
+
+	d.memCompaction()
+	d.assertLevelFilesNum(2)
+	check()
+
+	// range tombstone is kept above level 2, and split by output tables
+	compact = &compaction{level: 0, outputLevel: 1, grandparents: d.storage.levels[1]}
+	for i := len(d.storage.level0) - 1; i >= 0; i-- {
+		compact.inputs = append(compact.inputs, tables{d.storage.level0[i]})
+	}
+	d.db.majorCompaction(compact)
+	d.assertLevelFilesNum(0)
+	level1 := d.storage.levels[0]
+	rangeDels := 0
+	for i, tb := range level1 {
+		if i > 0 {
+			assert.LessOrEqual(t, string(level1[i-1].maxKey), string(tb.minKey))
+		}
+		r, err := d.storage.open(tb)
+		assert.NoError(t, err)
+		rangeDels += len(r.RangeTombstones())
+		r.Unref()
+	}
+	assert.Greater(t, rangeDels, 1)
+	check()
+
+	// tables covered by range tombstone are dropped, tombstones are dropped in the last level
+	d.db.majorCompaction(&compaction{level: 1, outputLevel: 2, inputs: []tables{level1, d.storage.levels[1]}})
+	d.assertLevelFilesNum(0, 0)
+	for _, tb := range d.storage.levels[1] {
+		assert.Zero(t, d.storage.tableProps(tb).numDeletions)
+	}
+	assert.Less(t, d.storage.levelSize(2), uint64(nRec-1701)*200)
+	check()
+}
+
+func TestDB_DeleteRangeMemTable(t *testing.T) {
+	d := newTestDB(t)
+	d.pauseCompactGoroutine()
+
+	nRec := d.bulkPut(64 * KB)
+	entries := func() (n int) {
+		for iter := NewSkiplistIterator(d.db.mtable.table); iter.Valid(); iter.Next() {
+			n++
+		}
+		return n
+	}
+	before := entries()
+
+	// keys of memtable are deleted without a tombstone per key
+	start, _ := getKV(100)
+	end, _ := getKV(300)
+	assert.NoError(t, d.db.DeleteRange([]byte(start), []byte(end)))
+	assert.Equal(t, before, entries())
+	d.put("0000000200", "put after deletion")
+
+	check := func() {
+		count := 0
+		for i := 0; i < nRec; i++ {
+			key, val := getKV(i)
+			if i == 200 {
+				val = "put after deletion"
+			} else if i >= 100 && i < 300 {
+				val = ""
+			}
+			d.get(key, val)
+			if val != "" {
+				count++
+			}
+		}
+
+		iter := d.db.NewIterator(nil)
+		defer iter.Close()
+		n := 0
+		for ; iter.Valid(); iter.Next() {
+			n++
+		}
+		assert.Equal(t, count, n)
+		iter.Seek([]byte(start))
+		assert.Equal(t, "0000000200", string(iter.Key()))
+	}
+	check()
+
+	// deleted keys are dropped by flush
+	d.memCompaction()
+	assert.Equal(t, uint64(nRec-199), d.storage.tableProps(d.storage.level0[0]).numEntries)
+	check()
+}
+
+func TestDB_FlushOverwrittenKeys(t *testing.T) {
+	d := newTestDB(t)
+	d.pauseCompactGoroutine()
+
+	// versions of a key span several blocks
+	value := func(i int) string {
+		return fmt.Sprintf("%03d-%v", i, strings.Repeat("v", 100))
+	}
+	for i := 0; i < 100; i++ {
+		d.put("k", value(i))
+	}
+	for i := 0; i < 60; i++ {
+		d.put("deleted", value(i))
+	}
+	assert.NoError(t, d.db.Delete([]byte("deleted")))
+
+	// only the newest version of each key is flushed
+	d.memCompaction()
+	assert.Equal(t, uint64(2), d.storage.tableProps(d.storage.level0[0]).numEntries)
+	d.get("k", value(99))
+	d.get("deleted", "")
 }
@@ -0,0 +1,31 @@
+/*
+Package lsm is an embedded key-value store based on a log-structured merge tree.
+
+Writes go to a journal and a memtable, which is flushed into level 0 tables and
+compacted into lower levels in background:
+
+	db, err := lsm.Open(&lsm.Config{Dir: "./data"})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.Put([]byte("k1"), []byte("v1")); err != nil {
+		return err
+	}
+	val := db.Get([]byte("k1"))
+
+Put, Delete and DeleteRange fail once a memtable flush failed, the database must
+be reopened then.
+
+NewIterator takes *IteratorOptions, nil iterates over the whole database. An
+iterator pins the tables and blob files it reads, so it must be closed after use,
+otherwise they are never deleted:
+
+	iter := db.NewIterator(&lsm.IteratorOptions{Prefix: []byte("k")})
+	defer iter.Close()
+	for ; iter.Valid(); iter.Next() {
+		fmt.Printf("%s: %s\n", iter.Key(), iter.Value())
+	}
+*/
+package lsm
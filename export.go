@@ -0,0 +1,287 @@
+package lsm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+var ErrCorruptedDump = errors.New("lsm-tree: corrupted dump")
+
+// scanSnapshot call fn for each key in [lower, upper), nil means unbounded. It reads a
+// snapshot taken when it starts, writes and compaction go on during scan. Error of reading
+// blob value is returned, instead of passing an empty value.
+func (d *DB) scanSnapshot(lower, upper []byte, fn func(key, val []byte) error) error {
+	iter := d.newSnapshotIterator()
+	defer iter.Close()
+	if lower != nil {
+		iter.Seek(lower)
+	}
+	for ; iter.Valid(); iter.Next() {
+		if upper != nil && d.cmp.Compare(iter.Key(), upper) >= 0 {
+			break
+		}
+		val, err := d.resolveValue(iter.Iterator.Value())
+		if err != nil {
+			return err
+		}
+		if err := fn(iter.Key(), val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newSnapshotIterator return iterator over a copy of memtable, the immutable memtable and
+// referenced tables, which are taken while writes are blocked
+func (d *DB) newSnapshotIterator() *DBIterator {
+	d.writeMu.Lock()
+	blobs := d.storage.refBlobs()
+	mtable, immtable := d.getMemTables(true)
+	mtable = mtable.clone()
+	v := d.storage.refVersion()
+	d.writeMu.Unlock()
+
+	return d.newIterator(mtable, immtable, v, blobs, nil)
+}
+
+// ExportRange write keys in [lower, upper) to sstables in dir, which can be added to
+// a database with the same config by DB.IngestExternalFiles. nil lower or upper means
+// unbounded. Paths of the written files are returned, no file is written if range is empty.
+func (d *DB) ExportRange(lower, upper []byte, dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0)
+	var w *SSTWriter
+	err := d.scanSnapshot(lower, upper, func(key, val []byte) error {
+		if w == nil {
+			path := filepath.Join(dir, fmt.Sprintf("export-%06d.sst", len(paths)))
+			var err error
+			if w, err = NewSSTWriter(path, d.cfg); err != nil {
+				return err
+			}
+			paths = append(paths, path)
+		}
+		if err := w.Put(key, val); err != nil {
+			return err
+		}
+
+		if w.w.EstimateSize() >= FileSize {
+			err := w.Finish()
+			w = nil
+			return err
+		}
+		return nil
+	})
+	if w != nil {
+		if finishErr := w.Finish(); err == nil {
+			err = finishErr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+const dumpMagic = "LSMDUMP1"
+
+const (
+	dumpRecord = iota + 1
+	dumpEnd
+)
+
+/*
+dump format:
+
+	| header | record1 | record2 | ... | end |
+
+header:
+
+	| magic (8 bytes) | len of comparator name | comparator name | crc32 of header |
+
+record:
+
+	| Record (1 byte) | len of key | len of value | key | value | crc32 of record |
+
+end:
+
+	| End (1 byte) | num of records | crc32 of end |
+*/
+type dumpWriter struct {
+	w   *bufio.Writer
+	buf []byte
+}
+
+func (w *dumpWriter) write(data []byte) error {
+	data = binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+	_, err := w.w.Write(data)
+	return err
+}
+
+// Dump write all key-value pairs in a logical format, which is independent of
+// file layout and config, and can be loaded by Load. Writes during dump aren't included.
+func (d *DB) Dump(w io.Writer) error {
+	dw := &dumpWriter{w: bufio.NewWriter(w)}
+
+	header := []byte(dumpMagic)
+	header = appendBytes(header, []byte(d.cmp.Name()))
+	if err := dw.write(header); err != nil {
+		return err
+	}
+
+	num := uint64(0)
+	err := d.scanSnapshot(nil, nil, func(key, val []byte) error {
+		dw.buf = append(dw.buf[:0], dumpRecord)
+		dw.buf = binary.AppendUvarint(dw.buf, uint64(len(key)))
+		dw.buf = binary.AppendUvarint(dw.buf, uint64(len(val)))
+		dw.buf = append(dw.buf, key...)
+		dw.buf = append(dw.buf, val...)
+		num += 1
+		return dw.write(dw.buf)
+	})
+	if err != nil {
+		return err
+	}
+
+	end := binary.AppendUvarint([]byte{dumpEnd}, num)
+	if err := dw.write(end); err != nil {
+		return err
+	}
+	return dw.w.Flush()
+}
+
+type dumpReader struct {
+	r   *bufio.Reader
+	crc uint32
+}
+
+// read n bytes, n isn't trusted before checksum is verified, so buffer grows with data
+// actually read instead of being allocated upfront
+func (r *dumpReader) read(n uint64) ([]byte, error) {
+	if n > math.MaxInt64 {
+		return nil, fmt.Errorf("%w: invalid length %v", ErrCorruptedDump, n)
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r.r, int64(n)); err != nil {
+		return nil, r.unexpected(err)
+	}
+	b := buf.Bytes()
+	r.crc = crc32.Update(r.crc, crc32.IEEETable, b)
+	return b, nil
+}
+
+func (r *dumpReader) uvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return 0, r.unexpected(err)
+	}
+	r.crc = crc32.Update(r.crc, crc32.IEEETable, binary.AppendUvarint(nil, v))
+	return v, nil
+}
+
+// checksum verify crc32 of data read since last call
+func (r *dumpReader) checksum() error {
+	var b [4]byte
+	if _, err := io.ReadFull(r.r, b[:]); err != nil {
+		return r.unexpected(err)
+	}
+	if binary.BigEndian.Uint32(b[:]) != r.crc {
+		return ErrCorruptedDump
+	}
+	r.crc = 0
+	return nil
+}
+
+func (r *dumpReader) unexpected(err error) error {
+	if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: unexpected end", ErrCorruptedDump)
+	}
+	return err
+}
+
+// Load put key-value pairs written by Dump. Records before a corrupted one are
+// already written when error is returned.
+func (d *DB) Load(r io.Reader) error {
+	dr := &dumpReader{r: bufio.NewReader(r)}
+
+	magic, err := dr.read(uint64(len(dumpMagic)))
+	if err != nil {
+		return err
+	}
+	if string(magic) != dumpMagic {
+		return fmt.Errorf("%w: invalid magic", ErrCorruptedDump)
+	}
+	n, err := dr.uvarint()
+	if err != nil {
+		return err
+	}
+	name, err := dr.read(n)
+	if err != nil {
+		return err
+	}
+	if err := dr.checksum(); err != nil {
+		return err
+	}
+	if string(name) != d.cmp.Name() {
+		return fmt.Errorf("lsm-tree: dump was written with comparator %q, but loaded with comparator %q", name, d.cmp.Name())
+	}
+
+	num := uint64(0)
+	for {
+		kind, err := dr.read(1)
+		if err != nil {
+			return err
+		}
+
+		switch kind[0] {
+		case dumpRecord:
+			keyLen, err := dr.uvarint()
+			if err != nil {
+				return err
+			}
+			valLen, err := dr.uvarint()
+			if err != nil {
+				return err
+			}
+			key, err := dr.read(keyLen)
+			if err != nil {
+				return err
+			}
+			val, err := dr.read(valLen)
+			if err != nil {
+				return err
+			}
+			if err := dr.checksum(); err != nil {
+				return err
+			}
+			if err := d.Put(key, val); err != nil {
+				return err
+			}
+			num += 1
+		case dumpEnd:
+			total, err := dr.uvarint()
+			if err != nil {
+				return err
+			}
+			if err := dr.checksum(); err != nil {
+				return err
+			}
+			if total != num {
+				return fmt.Errorf("%w: expect %v records, got %v", ErrCorruptedDump, total, num)
+			}
+			return nil
+		default:
+			return fmt.Errorf("%w: unknown record kind %v", ErrCorruptedDump, kind[0])
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package lsm
+
+import (
+	"time"
+)
+
+// FIFOCompactionPolicy keeps all tables in level 0 and drops the oldest ones, which suits
+// datasets like caches where old data can be lost. Data is never rewritten.
+type FIFOCompactionPolicy struct {
+	// MaxTableFilesSize drops the oldest tables once total size of tables exceeds it, 0 means unlimited
+	MaxTableFilesSize uint64
+	// TTL drops tables created more than TTL ago, 0 means no TTL. Expired tables are
+	// checked every CompactionCheckInterval.
+	TTL time.Duration
+}
+
+func NewFIFOCompactionPolicy(maxTableFilesSize uint64, ttl time.Duration) *FIFOCompactionPolicy {
+	return &FIFOCompactionPolicy{
+		MaxTableFilesSize: maxTableFilesSize,
+		TTL:               ttl,
+	}
+}
+
+func (p *FIFOCompactionPolicy) CompactionLevel(v *LevelsView) int {
+	if c := p.pickCompaction(v.s); c != nil {
+		return 0
+	}
+	return -1
+}
+
+func (p *FIFOCompactionPolicy) PickCompaction(v *LevelsView) *Compaction {
+	return v.export(p.pickCompaction(v.s))
+}
+
+// pickCompaction return a compaction deleting expired tables and the oldest tables beyond size limit
+func (p *FIFOCompactionPolicy) pickCompaction(s *Storage) *compaction {
+	// runs may change once running compaction is done
+	if len(s.compacting) > 0 {
+		return nil
+	}
+
+	total := uint64(0)
+	for _, t := range s.level0 {
+		total += t.size
+	}
+
+	now := time.Now()
+	drop := make(tables, 0)
+	// level 0 is ordered from the oldest table
+	for _, t := range s.level0 {
+		expired := p.TTL > 0 && now.Sub(time.Unix(t.createdAt, 0)) > p.TTL
+		oversize := p.MaxTableFilesSize > 0 && total > p.MaxTableFilesSize
+		if !expired && !oversize {
+			continue
+		}
+		drop = append(drop, t)
+		total -= t.size
+	}
+	if len(drop) == 0 {
+		return nil
+	}
+
+	return &compaction{
+		level:       0,
+		outputLevel: 0,
+		inputs:      []tables{drop},
+		deletion:    true,
+	}
+}
@@ -0,0 +1,216 @@
+package lsm
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+type IngestOptions struct {
+	// MoveFiles renames files into the database directory instead of copying them
+	MoveFiles bool
+}
+
+// externalFile is a sstable to be ingested
+type externalFile struct {
+	path string
+	size uint64
+
+	minKey, maxKey []byte
+}
+
+// IngestExternalFiles add sstables built by SSTWriter to the database. Data of
+// the files is newer than all existing data. Files mustn't overlap each other,
+// each file is placed at the deepest level it doesn't overlap, or level 0.
+// Memtable is flushed first if it overlaps any file.
+func (d *DB) IngestExternalFiles(paths []string, opts IngestOptions) error {
+	files := make([]*externalFile, 0, len(paths))
+	for _, path := range paths {
+		f, err := d.readExternalFile(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	for i := range files {
+		for j := i + 1; j < len(files); j++ {
+			if d.cmp.Compare(files[i].minKey, files[j].maxKey) <= 0 && d.cmp.Compare(files[j].minKey, files[i].maxKey) <= 0 {
+				return fmt.Errorf("lsm-tree: ingested files %v and %v overlap", files[i].path, files[j].path)
+			}
+		}
+	}
+
+	// no write can slip in between flush and ingestion
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	for _, f := range files {
+		if d.memOverlap(f.minKey, f.maxKey) {
+			if err := d.flushMemTable(); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	tables := make([]*table, 0, len(files))
+	for _, f := range files {
+		t := &table{
+			id:        d.storage.newFileId(),
+			size:      f.size,
+			createdAt: time.Now().Unix(),
+			minKey:    f.minKey,
+			maxKey:    f.maxKey,
+		}
+		if err := installFile(f.path, t.getTableName(), opts.MoveFiles); err != nil {
+			return err
+		}
+		tables = append(tables, t)
+	}
+
+	// level of files mustn't change during ingestion
+	d.compactMu.Lock()
+	defer d.compactMu.Unlock()
+	d.storage.ingestTables(tables)
+	return nil
+}
+
+// readExternalFile validate the file and return its key range
+func (d *DB) readExternalFile(path string) (*externalFile, error) {
+	r, err := NewSSTReader(path, d.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("lsm-tree: open external file %v err: %w", path, err)
+	}
+	defer r.Close()
+
+	info, err := r.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	f := &externalFile{path: path, size: uint64(info.Size())}
+
+	iter := r.r.NewIterator()
+	for ; iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if f.maxKey != nil && d.cmp.Compare(f.maxKey, key) >= 0 {
+			return nil, fmt.Errorf("lsm-tree: external file %v: %w", path, ErrKeysNotSorted)
+		}
+		if kind, _, err := decodeValue(iter.Value()); err != nil || kind != kindValue {
+			return nil, fmt.Errorf("lsm-tree: external file %v has invalid value of key %q", path, key)
+		}
+
+		if f.minKey == nil {
+			f.minKey = append([]byte(nil), key...)
+		}
+		f.maxKey = append(f.maxKey[:0], key...)
+	}
+	if f.minKey == nil {
+		return nil, fmt.Errorf("lsm-tree: external file %v: %w", path, ErrEmptyTable)
+	}
+	return f, nil
+}
+
+// memOverlap report whether memtables have keys or range tombstones in [minKey, maxKey],
+// nil means unbounded
+func (d *DB) memOverlap(minKey, maxKey []byte) bool {
+	mtable, immtable := d.getMemTables(true)
+	for _, m := range []*MemTable{mtable, immtable} {
+		if m == nil {
+			continue
+		}
+		iter := m.NewIterator()
+		if minKey != nil {
+			iter.Seek(minKey)
+		} else {
+			iter.First()
+		}
+		if iter.Valid() && (maxKey == nil || d.cmp.Compare(iter.Key(), maxKey) <= 0) {
+			return true
+		}
+		for _, t := range m.RangeTombstones() {
+			if (maxKey == nil || d.cmp.Compare(t.Start, maxKey) <= 0) && (minKey == nil || d.cmp.Compare(t.End, minKey) > 0) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func installFile(src, dst string, move bool) error {
+	if move {
+		return os.Rename(src, dst)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := openFile(dst, false)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// ingestTables assign a global sequence number to tables and add each of them to
+// the deepest level it doesn't overlap. The sequence number only tells age of tables, like
+// the largest sequence of flushed ones, reads prefer tables by position: a table appended
+// to level 0 is read first, and no table above a deeper level overlaps it.
+func (s *Storage) ingestTables(ts []*table) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastSequence += 1
+	for _, t := range ts {
+		t.seqNum = s.lastSequence
+
+		level := s.ingestLevel(t)
+		if level == 0 {
+			s.level0 = append(s.level0, t)
+			continue
+		}
+		s.levels[level-1] = append(s.levels[level-1], t)
+		s.levels[level-1].sort(s.cmp)
+	}
+
+	if err := s.saveManifest(); err != nil {
+		log.Printf("lsm-tree: save manifest err: %v", err)
+	}
+	s.checkCompaction()
+}
+
+// ingestLevel return the deepest level where table fits, caller should hold s.mu
+func (s *Storage) ingestLevel(t *table) int {
+	// FIFO compaction only drops tables of level 0
+	if _, ok := s.policy.(*FIFOCompactionPolicy); ok {
+		return 0
+	}
+
+	for _, lt := range s.level0 {
+		if s.cmp.Compare(lt.minKey, t.maxKey) <= 0 && s.cmp.Compare(lt.maxKey, t.minKey) >= 0 {
+			return 0
+		}
+	}
+
+	level := 0
+	for i := 1; i <= len(s.levels); i++ {
+		if len(s.overlapTables(i, t.minKey, t.maxKey)) > 0 {
+			break
+		}
+		level = i
+	}
+	return level
+}
@@ -1,6 +1,7 @@
 package iterator
 
 import (
+	"bytes"
 	"container/heap"
 	"lsm/compare"
 )
@@ -37,14 +38,24 @@ func NewTwoLevelIterator(idxIter IndexIterator) *TwoLevelIterator {
 func (t *TwoLevelIterator) First() {
 	t.IndexIterator.First()
 	t.Iterator = t.IndexIterator.Get()
+	t.skipForward()
 }
 
 func (t *TwoLevelIterator) Next() {
-	if t.Iterator != nil && t.Iterator.Valid() {
-		if t.Iterator.Next(); !t.Iterator.Valid() {
-			if t.IndexIterator.Next(); t.IndexIterator.Valid() {
-				t.Iterator = t.IndexIterator.Get()
-			}
+	if t.Valid() {
+		t.Iterator.Next()
+		t.skipForward()
+	}
+}
+
+// skipForward move to the first valid entry of following blocks if current one is exhausted
+func (t *TwoLevelIterator) skipForward() {
+	for (t.Iterator == nil || !t.Iterator.Valid()) && t.IndexIterator.Valid() {
+		if t.IndexIterator.Next(); !t.IndexIterator.Valid() {
+			return
+		}
+		if t.Iterator = t.IndexIterator.Get(); t.Iterator != nil {
+			t.Iterator.First()
 		}
 	}
 }
@@ -55,12 +66,14 @@ func (t *TwoLevelIterator) Prev() {
 
 func (t *TwoLevelIterator) Seek(key []byte) {
 	t.IndexIterator.Seek(key)
-	t.Iterator = t.IndexIterator.Get()
-	t.Iterator.Seek(key)
+	if t.Iterator = t.IndexIterator.Get(); t.Iterator != nil {
+		t.Iterator.Seek(key)
+	}
+	t.skipForward()
 }
 
 func (t *TwoLevelIterator) Valid() bool {
-	return t.Iterator.Valid()
+	return t.Iterator != nil && t.Iterator.Valid()
 }
 
 func (t *TwoLevelIterator) Key() []byte {
@@ -71,19 +84,49 @@ func (t *TwoLevelIterator) Value() []byte {
 	return t.Iterator.Value()
 }
 
+// RangeTombstone deletes keys in [Start, End) of older data
+type RangeTombstone struct {
+	Start, End []byte
+}
+
+// Covers report whether key is in [Start, End)
+func (t RangeTombstone) Covers(cmp compare.Comparator, key []byte) bool {
+	return cmp.Compare(t.Start, key) <= 0 && cmp.Compare(key, t.End) < 0
+}
+
+// Covered report whether any of tombstones covers key
+func Covered(cmp compare.Comparator, ts []RangeTombstone, key []byte) bool {
+	for _, t := range ts {
+		if t.Covers(cmp, key) {
+			return true
+		}
+	}
+	return false
+}
+
 type MergeIterator struct {
 	cmp compare.Comparator
 
 	idx []int
 
 	iters []Iterator
+	// range tombstones of each iterator, they delete keys of later iterators
+	tombstones [][]RangeTombstone
 }
 
 func NewMergeIterator(iters []Iterator, cmp compare.Comparator) *MergeIterator {
+	return NewMergeIteratorWithTombstones(iters, nil, cmp)
+}
+
+// NewMergeIteratorWithTombstones create merge iterator which skips keys deleted by range
+// tombstones, tombstones[i] belongs to iters[i] and deletes keys of iters[i+1:], which
+// hold older data
+func NewMergeIteratorWithTombstones(iters []Iterator, tombstones [][]RangeTombstone, cmp compare.Comparator) *MergeIterator {
 	m := &MergeIterator{
-		cmp:   cmp,
-		iters: iters,
-		idx:   make([]int, 0),
+		cmp:        cmp,
+		iters:      iters,
+		idx:        make([]int, 0),
+		tombstones: tombstones,
 	}
 	m.First()
 
@@ -135,15 +178,19 @@ func (m *MergeIterator) Next() {
 			heap.Push(m, idx)
 		}
 	}
+	m.skipCovered()
 }
 
 func (m *MergeIterator) First() {
 	m.idx = m.idx[:0]
 	for i, iter := range m.iters {
 		iter.First()
-		m.idx = append(m.idx, i)
+		if iter.Valid() {
+			m.idx = append(m.idx, i)
+		}
 	}
 	heap.Init(m)
+	m.skipCovered()
 }
 
 func (m *MergeIterator) Prev() {
@@ -160,6 +207,44 @@ func (m *MergeIterator) Seek(key []byte) {
 	}
 
 	heap.Init(m)
+	m.skipCovered()
+}
+
+// skipCovered move to the first key not deleted by range tombstones. Front iterator holds
+// the newest version of current key, so only tombstones of iterators before it apply.
+// Older iterators seek to the end of covering tombstone instead of visiting each key.
+func (m *MergeIterator) skipCovered() {
+	for m.Valid() {
+		front := m.idx[0]
+		i, end := m.covering(front, m.iters[front].Key())
+		if end == nil {
+			return
+		}
+
+		m.idx = m.idx[:0]
+		for j, iter := range m.iters {
+			if j > i && iter.Valid() && m.cmp.Compare(iter.Key(), end) < 0 {
+				iter.Seek(end)
+			}
+			if iter.Valid() {
+				m.idx = append(m.idx, j)
+			}
+		}
+		heap.Init(m)
+	}
+}
+
+// covering return index of iterator before n whose range tombstone covers key, and end
+// of the tombstone, end is nil if key isn't covered
+func (m *MergeIterator) covering(n int, key []byte) (int, []byte) {
+	for i := 0; i < n && i < len(m.tombstones); i++ {
+		for _, t := range m.tombstones[i] {
+			if t.Covers(m.cmp, key) {
+				return i, t.End
+			}
+		}
+	}
+	return -1, nil
 }
 
 func (m *MergeIterator) Valid() bool {
@@ -181,3 +266,72 @@ func (m *MergeIterator) Value() []byte {
 	front := m.idx[0]
 	return m.iters[front].Value()
 }
+
+// PrefixIterator restricts the underlying iterator to keys with prefix. If comparator is
+// compare.PrefixOrdered, it seeks to the prefix and stops at the first key without it,
+// otherwise all keys are scanned to find those with prefix.
+type PrefixIterator struct {
+	iter    Iterator
+	prefix  []byte
+	cmp     compare.Comparator
+	ordered bool
+}
+
+func NewPrefixIterator(iter Iterator, prefix []byte, cmp compare.Comparator) *PrefixIterator {
+	_, ordered := cmp.(compare.PrefixOrdered)
+	p := &PrefixIterator{
+		iter:    iter,
+		prefix:  prefix,
+		cmp:     cmp,
+		ordered: ordered,
+	}
+	p.First()
+	return p
+}
+
+func (p *PrefixIterator) First() {
+	if p.ordered {
+		p.iter.Seek(p.prefix)
+		return
+	}
+	p.iter.First()
+	p.skip()
+}
+
+func (p *PrefixIterator) Next() {
+	if p.Valid() {
+		p.iter.Next()
+		p.skip()
+	}
+}
+
+func (p *PrefixIterator) Prev() {
+	// TODO
+}
+
+func (p *PrefixIterator) Seek(key []byte) {
+	if p.ordered && p.cmp.Compare(key, p.prefix) < 0 {
+		key = p.prefix
+	}
+	p.iter.Seek(key)
+	p.skip()
+}
+
+// skip move to the next key with prefix if keys with prefix may not be adjacent
+func (p *PrefixIterator) skip() {
+	for !p.ordered && p.iter.Valid() && !bytes.HasPrefix(p.iter.Key(), p.prefix) {
+		p.iter.Next()
+	}
+}
+
+func (p *PrefixIterator) Valid() bool {
+	return p.iter.Valid() && bytes.HasPrefix(p.iter.Key(), p.prefix)
+}
+
+func (p *PrefixIterator) Key() []byte {
+	return p.iter.Key()
+}
+
+func (p *PrefixIterator) Value() []byte {
+	return p.iter.Value()
+}
@@ -1,7 +1,10 @@
 package lsm
 
 import (
+	"bufio"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 )
 
@@ -10,6 +13,10 @@ type WriteOperation uint8
 const (
 	WriteOperationPut WriteOperation = iota
 	WriteOperationDelete
+	// value is a pointer to blob file
+	WriteOperationPutBlobIndex
+	// deletes keys in [start, end)
+	WriteOperationDeleteRange
 )
 
 type journal struct {
@@ -48,29 +55,84 @@ format:
 	| Put (1 byte) | len of key | len of value | key | value |
 	or
 	| Delete (1 byte) | len of key | key |
+	or
+	| PutBlobIndex (1 byte) | len of key | len of blob index | key | blob index |
+	or
+	| DeleteRange (1 byte) | len of start | len of end | start | end |
 */
 func (j *journal) encodeWriteRecord(wop WriteOperation, data ...[]byte) []byte {
-	if (wop == WriteOperationPut && len(data) != 2) || (wop == WriteOperationDelete && len(data) != 1) {
+	hasValue := wop == WriteOperationPut || wop == WriteOperationPutBlobIndex || wop == WriteOperationDeleteRange
+	if (hasValue && len(data) != 2) || (wop == WriteOperationDelete && len(data) != 1) {
 		panic("error encode write operate")
 	}
 
 	j.buf[0] = byte(wop)
 	prefix := 1
 	prefix += binary.PutUvarint(j.buf[1:], uint64(len(data[0])))
-	if wop == WriteOperationPut {
+	if hasValue {
 		prefix += binary.PutUvarint(j.buf[prefix:], uint64(len(data[1])))
 	}
 
 	size := prefix + len(data[0])
-	if wop == WriteOperationPut {
+	if hasValue {
 		size += len(data[1])
 	}
 
 	b := make([]byte, size)
 	copy(b[:prefix], j.buf[:prefix])
 	copy(b[prefix:], data[0])
-	if wop == WriteOperationPut {
+	if hasValue {
 		copy(b[prefix+len(data[0]):], data[1])
 	}
 	return b
 }
+
+type journalReader struct {
+	r *bufio.Reader
+}
+
+func NewJournalReader(r io.Reader) *journalReader {
+	return &journalReader{bufio.NewReader(r)}
+}
+
+// ReadRecord return next record in journal, io.EOF is returned once reach the end.
+// A record that is partially written is regarded as the end of journal.
+func (j *journalReader) ReadRecord() (wop WriteOperation, data [][]byte, err error) {
+	op, err := j.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	wop = WriteOperation(op)
+	num := 1
+	switch wop {
+	case WriteOperationPut, WriteOperationPutBlobIndex, WriteOperationDeleteRange:
+		num = 2
+	case WriteOperationDelete:
+	default:
+		return 0, nil, fmt.Errorf("invalid write operation: %v", op)
+	}
+
+	lens := make([]uint64, num)
+	for i := range lens {
+		if lens[i], err = binary.ReadUvarint(j.r); err != nil {
+			return 0, nil, eofIfUnexpected(err)
+		}
+	}
+
+	data = make([][]byte, num)
+	for i, l := range lens {
+		data[i] = make([]byte, l)
+		if _, err := io.ReadFull(j.r, data[i]); err != nil {
+			return 0, nil, eofIfUnexpected(err)
+		}
+	}
+	return wop, data, nil
+}
+
+func eofIfUnexpected(err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return io.EOF
+	}
+	return err
+}
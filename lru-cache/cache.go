@@ -86,62 +86,102 @@ type LRUCache struct {
 
 	list  *lru
 	table map[uint64]*node
+	// called with value of entry once it's evicted or removed, nil values are skipped
+	onEvict func(val interface{})
 
 	mu sync.RWMutex
 }
 
 func NewLRUCache(capacity int64) *LRUCache {
+	return NewLRUCacheWithEvict(capacity, nil)
+}
+
+// NewLRUCacheWithEvict create cache which calls onEvict on values leaving the cache, so
+// that resources held by them can be released
+func NewLRUCacheWithEvict(capacity int64, onEvict func(val interface{})) *LRUCache {
 	cache := &LRUCache{
 		size:     0,
 		capacity: capacity,
 		list:     newLru(),
 		table:    make(map[uint64]*node),
+		onEvict:  onEvict,
 	}
 	return cache
 }
 
+func (c *LRUCache) evict(vals []interface{}) {
+	if c.onEvict == nil {
+		return
+	}
+	for _, val := range vals {
+		if val != nil {
+			c.onEvict(val)
+		}
+	}
+}
+
+// get return node of key and move it to head, it's done under read lock so that node
+// isn't evicted meanwhile
 func (c *LRUCache) get(key uint64) (*node, bool) {
 	c.mu.RLock()
-	n, ok := c.table[key]
-	c.mu.RUnlock()
+	defer c.mu.RUnlock()
 
+	n, ok := c.table[key]
+	if ok {
+		c.list.MoveToHead(n)
+	}
 	return n, ok
 }
 
 func (c *LRUCache) Get(key uint64, fetchFunc func() (val interface{}, size int64)) interface{} {
-	n, ok := c.get(key)
-	if !ok {
-		n = &node{key: key}
-		n.val, n.size = fetchFunc()
+	if n, ok := c.get(key); ok {
+		return n.val
+	}
+
+	n := &node{key: key}
+	n.val, n.size = fetchFunc()
 
-		c.mu.Lock()
+	evicted := make([]interface{}, 0)
+	c.mu.Lock()
+	if exist, ok := c.table[key]; ok {
+		// fetched concurrently, keep the cached one
+		evicted = append(evicted, n.val)
+		n = exist
+	} else {
 		c.table[key] = n
 		c.size += n.size
+	}
 
-		for c.size > c.capacity {
-			back := c.list.Back()
-			c.list.RemoveNode(back)
-			delete(c.table, back.key)
-			c.size -= back.size
+	for c.size > c.capacity {
+		back := c.list.Back()
+		if back == nil {
+			break
 		}
-
-		c.mu.Unlock()
+		c.list.RemoveNode(back)
+		delete(c.table, back.key)
+		c.size -= back.size
+		evicted = append(evicted, back.val)
 	}
 	c.list.MoveToHead(n)
+	c.mu.Unlock()
 
+	c.evict(evicted)
 	return n.val
 }
 
 func (c *LRUCache) Remove(key uint64) {
-	n, ok := c.get(key)
+	c.mu.Lock()
+	n, ok := c.table[key]
 	if ok {
-		c.mu.Lock()
 		delete(c.table, n.key)
 		c.size -= n.size
-		c.mu.Unlock()
-
 		c.list.RemoveNode(n)
 	}
+	c.mu.Unlock()
+
+	if ok {
+		c.evict([]interface{}{n.val})
+	}
 }
 
 type NamespaceCache struct {
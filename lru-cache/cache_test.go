@@ -63,3 +63,27 @@ func TestCacheRemove(t *testing.T) {
 		t.Error("expect fetchFunc to be executed 3 times")
 	}
 }
+
+func TestCacheEvict(t *testing.T) {
+	evicted := make([]int, 0)
+	lruCache := NewLRUCacheWithEvict(3, func(val interface{}) {
+		evicted = append(evicted, val.(int))
+	})
+
+	for i := 0; i < 5; i += 1 {
+		lruCache.Get(uint64(i), func() (interface{}, int64) {
+			return i, 1
+		})
+	}
+	lruCache.Remove(uint64(3))
+	lruCache.Remove(uint64(0))
+	// nil values aren't passed to onEvict
+	lruCache.Get(uint64(5), func() (interface{}, int64) {
+		return nil, 1
+	})
+	lruCache.Remove(uint64(5))
+
+	if len(evicted) != 3 || evicted[0] != 0 || evicted[1] != 1 || evicted[2] != 3 {
+		t.Errorf("unexpected evicted values: %v", evicted)
+	}
+}
@@ -0,0 +1,213 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+const (
+	tagComparator = iota + 1
+	tagNextFileId
+	tagLogNumber
+	tagTable
+	tagBlobFile
+	tagLastSequence
+	tagCompactPointer
+)
+
+var errCorruptedManifest = errors.New("corrupted manifest")
+
+/*
+manifest records a snapshot of the database metadata, it is rewritten as a whole whenever the metadata changes.
+
+manifest format:
+
+	| record1 | record2 | ... | crc32 of records |
+
+record format:
+
+	| Comparator (tag) | len of name | name |
+	| NextFileId (tag) | file id |
+	| LogNumber (tag) | file id |
+	| LastSequence (tag) | sequence number |
+	| Table (tag) | level | file id | file size | sequence number | creation time | len of min key | min key | len of max key | max key |
+	| BlobFile (tag) | file id | file size |
+	| CompactPointer (tag) | level | len of key | key |
+*/
+type manifest struct {
+	comparator string
+	nextFileId uint64
+	// journal files older than logNumber are no longer needed
+	logNumber uint64
+	// last global sequence number assigned to ingested tables
+	lastSequence uint64
+
+	// levels[0] is level 0
+	levels [][]*table
+	blobs  []*blobFile
+
+	// compactPointers[i] is the largest key of last applied compaction of level i
+	compactPointers [][]byte
+}
+
+func (m *manifest) encode() []byte {
+	buf := make([]byte, 0, 256)
+
+	buf = binary.AppendUvarint(buf, tagComparator)
+	buf = appendBytes(buf, []byte(m.comparator))
+
+	buf = binary.AppendUvarint(buf, tagNextFileId)
+	buf = binary.AppendUvarint(buf, m.nextFileId)
+
+	buf = binary.AppendUvarint(buf, tagLogNumber)
+	buf = binary.AppendUvarint(buf, m.logNumber)
+
+	buf = binary.AppendUvarint(buf, tagLastSequence)
+	buf = binary.AppendUvarint(buf, m.lastSequence)
+
+	for level, tables := range m.levels {
+		for _, t := range tables {
+			buf = binary.AppendUvarint(buf, tagTable)
+			buf = binary.AppendUvarint(buf, uint64(level))
+			buf = binary.AppendUvarint(buf, t.id)
+			buf = binary.AppendUvarint(buf, t.size)
+			buf = binary.AppendUvarint(buf, t.seqNum)
+			buf = binary.AppendUvarint(buf, uint64(t.createdAt))
+			buf = appendBytes(buf, t.minKey)
+			buf = appendBytes(buf, t.maxKey)
+		}
+	}
+
+	for _, bf := range m.blobs {
+		buf = binary.AppendUvarint(buf, tagBlobFile)
+		buf = binary.AppendUvarint(buf, bf.id)
+		buf = binary.AppendUvarint(buf, bf.size)
+	}
+
+	for level, key := range m.compactPointers {
+		if key == nil {
+			continue
+		}
+		buf = binary.AppendUvarint(buf, tagCompactPointer)
+		buf = binary.AppendUvarint(buf, uint64(level))
+		buf = appendBytes(buf, key)
+	}
+
+	return binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+func decodeManifest(data []byte) (*manifest, error) {
+	if len(data) < 4 {
+		return nil, errCorruptedManifest
+	}
+	n := len(data) - 4
+	if crc32.ChecksumIEEE(data[:n]) != binary.BigEndian.Uint32(data[n:]) {
+		return nil, errCorruptedManifest
+	}
+
+	m := &manifest{}
+	d := &decoder{buf: data[:n]}
+	for len(d.buf) > 0 && d.err == nil {
+		switch tag := d.uvarint(); tag {
+		case tagComparator:
+			m.comparator = string(d.bytes())
+		case tagNextFileId:
+			m.nextFileId = d.uvarint()
+		case tagLogNumber:
+			m.logNumber = d.uvarint()
+		case tagLastSequence:
+			m.lastSequence = d.uvarint()
+		case tagTable:
+			level := int(d.uvarint())
+			t := &table{
+				id:        d.uvarint(),
+				size:      d.uvarint(),
+				seqNum:    d.uvarint(),
+				createdAt: int64(d.uvarint()),
+				minKey:    d.bytes(),
+				maxKey:    d.bytes(),
+			}
+			for len(m.levels) <= level {
+				m.levels = append(m.levels, nil)
+			}
+			m.levels[level] = append(m.levels[level], t)
+		case tagBlobFile:
+			m.blobs = append(m.blobs, &blobFile{
+				id:   d.uvarint(),
+				size: d.uvarint(),
+			})
+		case tagCompactPointer:
+			level := int(d.uvarint())
+			key := d.bytes()
+			for len(m.compactPointers) <= level {
+				m.compactPointers = append(m.compactPointers, nil)
+			}
+			m.compactPointers[level] = key
+		default:
+			return nil, fmt.Errorf("%w: unknown tag %v", errCorruptedManifest, tag)
+		}
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	return m, nil
+}
+
+func readManifest() (*manifest, error) {
+	data, err := os.ReadFile(fileName(ManifestFile, 0))
+	if err != nil {
+		return nil, err
+	}
+	return decodeManifest(data)
+}
+
+// writeManifest replace the manifest atomically
+func writeManifest(m *manifest) error {
+	name := fileName(ManifestFile, 0)
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, m.encode(), 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func appendBytes(buf, data []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errCorruptedManifest
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	l := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if uint64(len(d.buf)) < l {
+		d.err = errCorruptedManifest
+		return nil
+	}
+	b := append([]byte(nil), d.buf[:l]...)
+	d.buf = d.buf[l:]
+	return b
+}
@@ -9,33 +9,115 @@ import (
 type MemTable struct {
 	size  int
 	table *SkipList
+	cmp   compare.Comparator
+	// sequence number of the last write, keys and range tombstones are ordered by it
+	seq uint64
+	// range tombstones delete keys of this memtable written before them, and all keys of
+	// older memtable and sstables
+	rangeDels []memRangeTombstone
 
 	mu sync.RWMutex
 	wg sync.WaitGroup
 
 	compacting bool
+
+	// id of journal file that records writes of this memtable
+	logId uint64
 }
 
 func NewMemTable(cmp compare.Comparator) *MemTable {
 	return &MemTable{
 		table:      NewSkiplist(cmp),
+		cmp:        cmp,
 		compacting: false,
 	}
 }
 
+type memRangeTombstone struct {
+	iterator.RangeTombstone
+	seq uint64
+}
+
+// deletedBy report whether key written at seq is deleted by any of range tombstones
+func deletedBy(cmp compare.Comparator, rangeDels []memRangeTombstone, key []byte, seq uint64) bool {
+	for _, t := range rangeDels {
+		if t.seq > seq && t.Covers(cmp, key) {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *MemTable) Put(key, val []byte) {
 	m.mu.Lock()
-	m.table.Insert(key, val)
+	m.seq += 1
+	m.table.InsertSeq(key, val, m.seq)
 	m.size = m.size + len(key) + len(val)
 	m.mu.Unlock()
 }
 
+// DeleteRange delete keys in [start, end), keys put later aren't affected
+func (m *MemTable) DeleteRange(start, end []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.seq += 1
+	m.rangeDels = append(m.rangeDels, memRangeTombstone{iterator.RangeTombstone{Start: start, End: end}, m.seq})
+	m.size += len(start) + len(end)
+}
+
+// Get return point tombstone if key is deleted by range tombstone
 func (m *MemTable) Get(key []byte) ([]byte, bool) {
 	m.mu.RLock()
-	val, ok := m.table.Get(key)
-	m.mu.RUnlock()
+	defer m.mu.RUnlock()
+
+	// the newest version comes first
+	seq := uint64(0)
+	node := m.table.findGreaterOrEqual(key, nil)
+	found := node != nil && m.cmp.Compare(node.key, key) == 0
+	if found {
+		seq = node.seq
+	}
+	if deletedBy(m.cmp, m.rangeDels, key, seq) {
+		return encodeValue(kindDeletion, nil), true
+	}
+	if found {
+		return append([]byte(nil), node.val...), true
+	}
+	return nil, false
+}
+
+// RangeTombstones return range tombstones in order of deletion
+func (m *MemTable) RangeTombstones() []iterator.RangeTombstone {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
-	return val, ok
+	ts := make([]iterator.RangeTombstone, 0, len(m.rangeDels))
+	for _, t := range m.rangeDels {
+		ts = append(ts, t.RangeTombstone)
+	}
+	return ts
+}
+
+// clone return a copy of memtable which later writes don't change, only the newest version
+// of each key is kept. Caller should block writes to memtable.
+func (m *MemTable) clone() *MemTable {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	c := NewMemTable(m.cmp)
+	var last []byte
+	for iter := NewSkiplistIterator(m.table); iter.Valid(); iter.Next() {
+		// overwritten key has older versions right after it
+		if last != nil && m.cmp.Compare(last, iter.Key()) == 0 {
+			continue
+		}
+		last = iter.Key()
+		c.table.InsertSeq(iter.Key(), iter.Value(), iter.Seq())
+	}
+	c.rangeDels = append(c.rangeDels, m.rangeDels...)
+	c.seq, c.size = m.seq, m.size
+	return c
 }
 
 func (m *MemTable) Scan(lower, upper []byte) *MemTableIterator {
@@ -43,9 +125,16 @@ func (m *MemTable) Scan(lower, upper []byte) *MemTableIterator {
 	return nil
 }
 
+// NewIterator return iterator skipping keys deleted by range tombstones of memtable, keys
+// deleted by later range tombstones are still returned
 func (m *MemTable) NewIterator() *MemTableIterator {
-	iter := NewSkiplistIterator(m.table)
-	return &MemTableIterator{iter}
+	m.mu.RLock()
+	rangeDels := append([]memRangeTombstone(nil), m.rangeDels...)
+	m.mu.RUnlock()
+
+	iter := &MemTableIterator{SkipListIter: NewSkiplistIterator(m.table), cmp: m.cmp, rangeDels: rangeDels}
+	iter.skipDeleted()
+	return iter
 }
 
 func (m *MemTable) estimateSize() int {
@@ -66,10 +155,36 @@ func (m *MemTable) wait() {
 
 type MemTableIterator struct {
 	*SkipListIter
+
+	cmp       compare.Comparator
+	rangeDels []memRangeTombstone
 }
 
 var _ iterator.Iterator = (*MemTableIterator)(nil)
 
+func (i *MemTableIterator) First() {
+	i.SkipListIter.First()
+	i.skipDeleted()
+}
+
+func (i *MemTableIterator) Next() {
+	i.SkipListIter.Next()
+	i.skipDeleted()
+}
+
+func (i *MemTableIterator) Seek(key []byte) {
+	i.SkipListIter.Seek(key)
+	i.skipDeleted()
+}
+
+// skipDeleted move to the first key not deleted by range tombstones, older versions of
+// a deleted key are deleted too
+func (i *MemTableIterator) skipDeleted() {
+	for len(i.rangeDels) > 0 && i.Valid() && deletedBy(i.cmp, i.rangeDels, i.Key(), i.Seq()) {
+		i.SkipListIter.Next()
+	}
+}
+
 func NewMemtableIterator(list *SkipList) *MemTableIterator {
 	return &MemTableIterator{
 		SkipListIter: NewSkiplistIterator(list),
@@ -0,0 +1,511 @@
+package lsm
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// CompactionPolicy decides when and which tables are compacted. Methods are called with
+// levels locked, view is only valid during the call.
+type CompactionPolicy interface {
+	// CompactionLevel return level of the newest input of next compaction, -1 if no compaction is needed
+	CompactionLevel(v *LevelsView) int
+	// PickCompaction return next compaction, nil if no compaction is needed. Tables being
+	// compacted mustn't be picked.
+	PickCompaction(v *LevelsView) *Compaction
+}
+
+// TableInfo describes a table to compaction policy
+type TableInfo struct {
+	ID   uint64
+	Size uint64
+	// the smallest and the largest key of table, they mustn't be modified
+	MinKey, MaxKey []byte
+	CreatedAt      time.Time
+	// Compacting reports whether table is an input of running compaction
+	Compacting bool
+}
+
+// Compaction is picked by compaction policy, tables of Inputs are merged into OutputLevel.
+// Tables of OutputLevel overlapping the inputs must be inputs too, unless OutputLevel is 0.
+type Compaction struct {
+	// Level is the level of the newest input
+	Level, OutputLevel int
+	// Inputs are sorted runs to merge, newer run comes first, tables of a run mustn't
+	// overlap each other
+	Inputs [][]TableInfo
+	// Deletion drops inputs without output
+	Deletion bool
+
+	// picked by builtin policy, nil for other policies
+	c *compaction
+}
+
+// LevelsView is a read-only view of levels for compaction policy
+type LevelsView struct {
+	s *Storage
+}
+
+// NumLevels return number of levels below level 0
+func (v *LevelsView) NumLevels() int {
+	return len(v.s.levels)
+}
+
+// Tables return tables of level, tables of level 0 are ordered from the oldest one, and
+// tables of other levels are ordered by key
+func (v *LevelsView) Tables(level int) []TableInfo {
+	if level < 0 || level > len(v.s.levels) {
+		return nil
+	}
+	return v.s.tableInfos(v.s.levelTables(level))
+}
+
+// LevelSize return total size of tables of level
+func (v *LevelsView) LevelSize(level int) uint64 {
+	size := uint64(0)
+	if level >= 0 && level <= len(v.s.levels) {
+		for _, t := range v.s.levelTables(level) {
+			size += t.size
+		}
+	}
+	return size
+}
+
+// Overlaps return tables of level other than level 0 whose key range overlaps [minKey, maxKey]
+func (v *LevelsView) Overlaps(level int, minKey, maxKey []byte) []TableInfo {
+	if level < 1 {
+		return nil
+	}
+	return v.s.tableInfos(v.s.overlapTables(level, minKey, maxKey))
+}
+
+// Compare compare keys with comparator of database
+func (v *LevelsView) Compare(a, b []byte) int {
+	return v.s.cmp.Compare(a, b)
+}
+
+// export describe compaction picked by builtin policy
+func (v *LevelsView) export(c *compaction) *Compaction {
+	if c == nil {
+		return nil
+	}
+	comp := &Compaction{
+		Level:       c.level,
+		OutputLevel: c.outputLevel,
+		Deletion:    c.deletion,
+		c:           c,
+	}
+	for _, run := range c.inputs {
+		comp.Inputs = append(comp.Inputs, v.s.tableInfos(run))
+	}
+	return comp
+}
+
+// tableInfos describe tables to compaction policy, caller should hold s.mu
+func (s *Storage) tableInfos(ts tables) []TableInfo {
+	infos := make([]TableInfo, 0, len(ts))
+	for _, t := range ts {
+		infos = append(infos, TableInfo{
+			ID:         t.id,
+			Size:       t.size,
+			MinKey:     t.minKey,
+			MaxKey:     t.maxKey,
+			CreatedAt:  time.Unix(t.createdAt, 0),
+			Compacting: s.compacting[t.id],
+		})
+	}
+	return infos
+}
+
+// resolveCompaction build compaction picked by policy other than builtin ones, nil if it
+// refers to tables that don't exist or are being compacted, or misses overlapping tables
+// of output level. Caller should hold s.mu.
+func (s *Storage) resolveCompaction(c *Compaction) *compaction {
+	if c.Level < 0 || c.Level > len(s.levels) || c.OutputLevel < 0 || c.OutputLevel > len(s.levels) {
+		log.Printf("lsm-tree: invalid compaction from level %v to level %v", c.Level, c.OutputLevel)
+		return nil
+	}
+
+	byId := make(map[uint64]*table)
+	for level := 0; level <= len(s.levels); level++ {
+		for _, t := range s.levelTables(level) {
+			byId[t.id] = t
+		}
+	}
+	compact := &compaction{
+		level:       c.Level,
+		outputLevel: c.OutputLevel,
+		deletion:    c.Deletion,
+	}
+	picked := make(map[uint64]bool)
+	for _, run := range c.Inputs {
+		ts := make(tables, 0, len(run))
+		for _, info := range run {
+			t, ok := byId[info.ID]
+			if !ok || s.compacting[t.id] || picked[t.id] {
+				log.Printf("lsm-tree: invalid compaction input table %v", info.ID)
+				return nil
+			}
+			picked[t.id] = true
+			ts = append(ts, t)
+		}
+		if len(ts) > 0 {
+			compact.inputs = append(compact.inputs, ts)
+		}
+	}
+	if len(compact.inputs) == 0 {
+		return nil
+	}
+	if compact.deletion || compact.outputLevel == 0 {
+		return compact
+	}
+
+	minKey, maxKey := s.keyRange(compact.allTables())
+	for _, t := range s.overlapTables(compact.outputLevel, minKey, maxKey) {
+		if !picked[t.id] {
+			log.Printf("lsm-tree: invalid compaction, table %v of output level %v isn't picked", t.id, compact.outputLevel)
+			return nil
+		}
+	}
+	compact.grandparents = s.overlapTables(compact.outputLevel+1, minKey, maxKey)
+	return compact
+}
+
+// CompactionPriority decides which table of a level is compacted first
+type CompactionPriority int
+
+const (
+	// tables are compacted in turn, starting after the last compacted key of the level
+	PriorityRoundRobin CompactionPriority = iota
+	// table with the least bytes of next level overlapping per byte of it, which has the
+	// least write amplification
+	PriorityMinOverlappingRatio
+	// table whose newest data is the oldest, so that cold data moves down first
+	PriorityOldestLargestSeqFirst
+	// table with the largest compensated size, so that tombstones are dropped early
+	PriorityLargestCompensatedSize
+)
+
+// LeveledCompactionPolicy keeps one sorted run per level, and each level is SizeMultiplier
+// times larger than the previous one. Level is compacted into next level once it grows
+// beyond its size, it has low read and space amplification at the cost of write amplification.
+type LeveledCompactionPolicy struct {
+	// DynamicLevelBytes derives target sizes backward from the size of the last non-empty
+	// level instead of Level1FilesSize. Level 0 is compacted into the first level whose
+	// target is at least Level1FilesSize, levels above it stay empty until data grows, so
+	// most data is in the last level and space amplification stays near 1.1x.
+	DynamicLevelBytes bool
+
+	// TTL moves tables older than TTL to the next level, so that old data which is never
+	// overwritten reaches the last level. A trivially moved table keeps its creation time,
+	// so it moves on in the next pass, while merged output waits another TTL. 0 disables it.
+	TTL time.Duration
+	// PeriodicCompaction rewrites tables older than PeriodicCompaction, tables of the last
+	// level are rewritten in place. 0 disables it.
+	PeriodicCompaction time.Duration
+
+	// Priority decides which table is picked from a level, default: PriorityRoundRobin
+	Priority CompactionPriority
+}
+
+func NewLeveledCompactionPolicy() CompactionPolicy {
+	return &LeveledCompactionPolicy{}
+}
+
+// levelTargets return target size of each level indexed by level, and the base level which
+// level 0 is compacted into. Levels above base level are empty and have no target.
+func (p *LeveledCompactionPolicy) levelTargets(s *Storage) ([]uint64, int) {
+	last := len(s.levels)
+	targets := make([]uint64, last+1)
+	if !p.DynamicLevelBytes {
+		for level := 1; level <= last; level++ {
+			targets[level] = levelFilesSize(level)
+		}
+		return targets, 1
+	}
+
+	// the last level is as large as the deepest data
+	first := 0
+	for level := last; level >= 1; level-- {
+		if size := s.levelSize(level); size > 0 {
+			if targets[last] == 0 {
+				targets[last] = size
+			}
+			first = level
+		}
+	}
+
+	base := last
+	for base > 1 && targets[base]/uint64(SizeMultiplier) >= uint64(Level1FilesSize) {
+		targets[base-1] = targets[base] / uint64(SizeMultiplier)
+		base -= 1
+	}
+	// data above base level, e.g. written with static targets, is moved down in turn
+	for first > 0 && base > first {
+		targets[base-1] = targets[base] / uint64(SizeMultiplier)
+		if targets[base-1] == 0 {
+			targets[base-1] = 1
+		}
+		base -= 1
+	}
+	return targets, base
+}
+
+// score return how much level needs compaction, level needs compaction if score >= 1.
+// Level 0 is scored by number of files, since each file of level 0 may overlap others
+// and slow down reads. The last level is never compacted.
+func (p *LeveledCompactionPolicy) score(s *Storage, level int, targets []uint64) float64 {
+	if level == 0 {
+		return float64(len(s.level0)) / float64(Level0FileNumber+1)
+	}
+	if level >= len(s.levels) || targets[level] == 0 {
+		return 0
+	}
+	return float64(s.levelSize(level)) / float64(targets[level])
+}
+
+// candidateLevels return levels needing compaction, level 0 comes first since too many
+// tables in level 0 slow down reads, the other levels are ordered by score
+func (p *LeveledCompactionPolicy) candidateLevels(s *Storage, targets []uint64) []int {
+	levels := make([]int, 0)
+	scores := make(map[int]float64)
+	for level := 0; level <= len(s.levels); level++ {
+		if score := p.score(s, level, targets); score >= 1 {
+			levels = append(levels, level)
+			scores[level] = score
+		}
+	}
+	sort.SliceStable(levels, func(i, j int) bool {
+		if levels[i] == 0 || levels[j] == 0 {
+			return levels[i] == 0
+		}
+		return scores[levels[i]] > scores[levels[j]]
+	})
+	return levels
+}
+
+func (p *LeveledCompactionPolicy) CompactionLevel(v *LevelsView) int {
+	s := v.s
+	targets, base := p.levelTargets(s)
+	if levels := p.candidateLevels(s, targets); len(levels) > 0 {
+		return levels[0]
+	}
+	if s.seekCompact != nil {
+		return s.seekCompactLevel
+	}
+	if aged := p.agedTables(s, base); len(aged) > 0 {
+		return aged[0].level
+	}
+	return -1
+}
+
+func (p *LeveledCompactionPolicy) PickCompaction(v *LevelsView) *Compaction {
+	return v.export(p.pickCompaction(v.s))
+}
+
+// pickCompaction pick tables of the first candidate level that doesn't conflict with running
+// compactions. If no level is too large, table which used up allowed seeks is picked, then
+// tables older than TTL or PeriodicCompaction.
+func (p *LeveledCompactionPolicy) pickCompaction(s *Storage) *compaction {
+	targets, base := p.levelTargets(s)
+	for _, level := range p.candidateLevels(s, targets) {
+		outputLevel := level + 1
+		if level == 0 {
+			outputLevel = base
+		}
+		if comp := p.pickLevel(s, level, outputLevel, nil); comp != nil {
+			return comp
+		}
+	}
+	if comp := p.pickSeek(s, base); comp != nil {
+		return comp
+	}
+	for _, aged := range p.agedTables(s, base) {
+		if comp := p.pickLevel(s, aged.level, aged.outputLevel, aged.t); comp != nil {
+			return comp
+		}
+	}
+	return nil
+}
+
+type agedTable struct {
+	t                  *table
+	level, outputLevel int
+}
+
+// agedTables return tables older than TTL which are moved to next level, followed by
+// tables older than PeriodicCompaction which are rewritten
+func (p *LeveledCompactionPolicy) agedTables(s *Storage, base int) []agedTable {
+	now := time.Now()
+	olderThan := func(t *table, d time.Duration) bool {
+		return d > 0 && now.Sub(time.Unix(t.createdAt, 0)) > d
+	}
+	nextLevel := func(level int) int {
+		if level == 0 {
+			return base
+		}
+		return level + 1
+	}
+
+	aged := make([]agedTable, 0)
+	last := len(s.levels)
+	for level := 0; level < last; level++ {
+		for _, t := range s.levelTables(level) {
+			if olderThan(t, p.TTL) {
+				aged = append(aged, agedTable{t, level, nextLevel(level)})
+			}
+		}
+	}
+	for level := 0; level <= last; level++ {
+		for _, t := range s.levelTables(level) {
+			if !olderThan(t, p.PeriodicCompaction) {
+				continue
+			}
+			if level == last {
+				aged = append(aged, agedTable{t, level, level})
+			} else {
+				aged = append(aged, agedTable{t, level, nextLevel(level)})
+			}
+		}
+	}
+	return aged
+}
+
+func (p *LeveledCompactionPolicy) pickSeek(s *Storage, base int) *compaction {
+	t, level := s.seekCompact, s.seekCompactLevel
+	if t == nil {
+		return nil
+	}
+	// table may be compacted already, and the last level is never compacted
+	ts := s.level0
+	if level > 0 && level < len(s.levels) {
+		ts = s.levels[level-1]
+	}
+	found := false
+	for _, tt := range ts {
+		if tt == t {
+			found = true
+			break
+		}
+	}
+	if !found || level >= len(s.levels) {
+		s.seekCompact = nil
+		return nil
+	}
+
+	outputLevel := level + 1
+	if level == 0 {
+		outputLevel = base
+	}
+	comp := p.pickLevel(s, level, outputLevel, t)
+	if comp != nil {
+		s.seekCompact = nil
+	}
+	return comp
+}
+
+// orderTables return tables of level in the order they should be compacted
+func (p *LeveledCompactionPolicy) orderTables(s *Storage, level, outputLevel int) tables {
+	ts := append(tables{}, s.levels[level-1]...)
+	switch p.Priority {
+	case PriorityMinOverlappingRatio:
+		ratio := make(map[*table]float64, len(ts))
+		for _, t := range ts {
+			overlap := uint64(0)
+			if outputLevel != level {
+				for _, o := range s.overlapTables(outputLevel, t.minKey, t.maxKey) {
+					overlap += o.size
+				}
+			}
+			ratio[t] = float64(overlap) / float64(s.compensatedSize(t))
+		}
+		sort.SliceStable(ts, func(i, j int) bool { return ratio[ts[i]] < ratio[ts[j]] })
+	case PriorityOldestLargestSeqFirst:
+		sort.SliceStable(ts, func(i, j int) bool {
+			return s.tableProps(ts[i]).largestSeq < s.tableProps(ts[j]).largestSeq
+		})
+	case PriorityLargestCompensatedSize:
+		sort.SliceStable(ts, func(i, j int) bool {
+			return s.compensatedSize(ts[i]) > s.compensatedSize(ts[j])
+		})
+	default:
+		// start after compaction pointer, and wrap around to the beginning of key space
+		idx := 0
+		if pointer := s.compactPointers[level]; pointer != nil {
+			idx = sort.Search(len(ts), func(i int) bool {
+				return s.cmp.Compare(ts[i].maxKey, pointer) > 0
+			})
+		}
+		ts = append(append(tables{}, ts[idx:]...), ts[:idx]...)
+	}
+	return ts
+}
+
+// pickLevel pick tables of level, nil if they are being compacted. Tables of level 0 may
+// overlap each other, so all of them are compacted together with tables of level 1
+// overlapping any of them. For other levels, tables are tried in order of Priority, and the
+// first one that isn't being compacted is picked.
+// If only isn't nil, only the table is picked from level other than level 0. If output level
+// is the same level, the table is rewritten in place.
+func (p *LeveledCompactionPolicy) pickLevel(s *Storage, level, outputLevel int, only *table) *compaction {
+	comp := &compaction{
+		level:       level,
+		outputLevel: outputLevel,
+	}
+
+	var picked, overlap tables
+	if level == 0 {
+		picked = append(tables{}, s.level0...)
+		if s.isCompacting(picked...) {
+			return nil
+		}
+		minKey, maxKey := s.keyRange(picked)
+		overlap = s.overlapTables(outputLevel, minKey, maxKey)
+		if s.isCompacting(overlap...) {
+			return nil
+		}
+	} else {
+		ts := tables{only}
+		if only == nil {
+			ts = p.orderTables(s, level, outputLevel)
+		}
+		for _, t := range ts {
+			if s.isCompacting(t) {
+				continue
+			}
+			if outputLevel == level {
+				picked = tables{t}
+				break
+			}
+			if overlap = s.overlapTables(outputLevel, t.minKey, t.maxKey); !s.isCompacting(overlap...) {
+				picked = tables{t}
+				break
+			}
+		}
+		if picked == nil {
+			return nil
+		}
+	}
+
+	if level == 0 {
+		// newer table comes first
+		for i := len(picked) - 1; i >= 0; i-- {
+			comp.inputs = append(comp.inputs, tables{picked[i]})
+		}
+	} else {
+		comp.inputs = append(comp.inputs, picked)
+	}
+	if len(overlap) > 0 {
+		comp.inputs = append(comp.inputs, overlap)
+	}
+
+	// output tables mustn't overlap too many tables of grandparent level
+	allMin, allMax := s.keyRange(comp.allTables())
+	comp.grandparents = s.overlapTables(outputLevel+1, allMin, allMax)
+
+	// next compaction of level starts after this one once it's applied
+	_, comp.compactPointer = s.keyRange(picked)
+
+	return comp
+}
@@ -0,0 +1,127 @@
+package lsm
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+type ioPriority int
+
+const (
+	// compactions
+	ioPriorityLow ioPriority = iota
+	// flushes
+	ioPriorityHigh
+)
+
+// tokens are refilled at most every refillPeriod, which is also the largest burst
+const refillPeriod = 100 * time.Millisecond
+
+// RateLimiter limits the bytes per second written by flushes, compactions and blob garbage
+// collection with a token bucket, one limiter can be shared by several databases. Flushes
+// are served before the others, so that writes aren't stalled by a full memtable.
+type RateLimiter struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	bytesPerSec int64
+	// tokens may go negative when a write is larger than the bucket
+	available  float64
+	lastRefill time.Time
+	// number of flushes waiting for tokens, compactions wait until it's 0
+	highWaiting int
+}
+
+// NewRateLimiter create a limiter of bytesPerSec, 0 or less means unlimited
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	r := &RateLimiter{
+		bytesPerSec: bytesPerSec,
+		lastRefill:  time.Now(),
+	}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+// SetBytesPerSecond change the limit, it takes effect on waiting writes as well
+func (r *RateLimiter) SetBytesPerSecond(bytesPerSec int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.refill()
+	r.bytesPerSec = bytesPerSec
+	if burst := r.burst(); r.available > burst {
+		r.available = burst
+	}
+	r.cond.Broadcast()
+}
+
+func (r *RateLimiter) BytesPerSecond() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.bytesPerSec
+}
+
+func (r *RateLimiter) burst() float64 {
+	return float64(r.bytesPerSec) * refillPeriod.Seconds()
+}
+
+func (r *RateLimiter) refill() {
+	now := time.Now()
+	r.available += float64(r.bytesPerSec) * now.Sub(r.lastRefill).Seconds()
+	if burst := r.burst(); r.available > burst {
+		r.available = burst
+	}
+	r.lastRefill = now
+}
+
+// request block until n bytes can be written
+func (r *RateLimiter) request(n int, pri ioPriority) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if pri == ioPriorityHigh {
+		r.highWaiting += 1
+		defer func() {
+			if r.highWaiting -= 1; r.highWaiting == 0 {
+				r.cond.Broadcast()
+			}
+		}()
+	}
+
+	for {
+		for pri == ioPriorityLow && r.highWaiting > 0 {
+			r.cond.Wait()
+		}
+		if r.bytesPerSec <= 0 {
+			return
+		}
+
+		r.refill()
+		if r.available > 0 {
+			r.available -= float64(n)
+			return
+		}
+
+		// sleep until the debt is paid, but wake up in time for changed limit
+		wait := time.Duration(-r.available / float64(r.bytesPerSec) * float64(time.Second))
+		if wait > refillPeriod {
+			wait = refillPeriod
+		}
+		r.mu.Unlock()
+		time.Sleep(wait + time.Millisecond)
+		r.mu.Lock()
+	}
+}
+
+// rateLimitedWriter charges every write of sstable or blob file to the rate limiter
+type rateLimitedWriter struct {
+	io.WriteCloser
+	limiter *RateLimiter
+	pri     ioPriority
+}
+
+func (w *rateLimitedWriter) Write(p []byte) (int, error) {
+	w.limiter.request(len(p), w.pri)
+	return w.WriteCloser.Write(p)
+}
@@ -1,7 +1,6 @@
 package lsm
 
 import (
-	"bytes"
 	"lsm/compare"
 	"math/rand"
 )
@@ -9,6 +8,8 @@ import (
 type Node struct {
 	key []byte
 	val []byte
+	// order of insertion, set by memtable
+	seq uint64
 
 	forward []*Node
 }
@@ -46,7 +47,7 @@ func NewSkiplist(cmp compare.Comparator) *SkipList {
 func (l *SkipList) findGreaterOrEqual(key []byte, prev []*Node) *Node {
 	node := l.head
 	for i := int(l.curHeight); i >= 0; i-- {
-		for node.forward[i] != nil && bytes.Compare(node.forward[i].key, key) < 0 {
+		for node.forward[i] != nil && l.cmp.Compare(node.forward[i].key, key) < 0 {
 			node = node.forward[i]
 		}
 		if prev != nil {
@@ -67,11 +68,18 @@ func (l *SkipList) Get(key []byte) (val []byte, exist bool) {
 }
 
 func (l *SkipList) Insert(key, val []byte) {
-	prev := make([]*Node, l.maxHeight)
+	l.InsertSeq(key, val, 0)
+}
+
+// InsertSeq insert key with sequence number, it's put before older versions of key
+func (l *SkipList) InsertSeq(key, val []byte, seq uint64) {
+	// levels of node are 0 to height, and height is at most maxHeight
+	prev := make([]*Node, l.maxHeight+1)
 	l.findGreaterOrEqual(key, prev)
 
 	height := l.randomHeight()
 	newNode := NewNode(key, val, height)
+	newNode.seq = seq
 	if height > l.curHeight {
 		for i := l.curHeight + 1; i <= height; i++ {
 			prev[i] = l.head
@@ -117,6 +125,10 @@ func (i *SkipListIter) Value() []byte {
 	return i.node.val
 }
 
+func (i *SkipListIter) Seq() uint64 {
+	return i.node.seq
+}
+
 func (i *SkipListIter) Next() {
 	if i.node != nil {
 		i.node = i.node.forward[0]
@@ -0,0 +1,126 @@
+package lsm
+
+import (
+	"errors"
+	"log"
+	"lsm/compare"
+	"lsm/iterator"
+	cache "lsm/lru-cache"
+	"lsm/sstable"
+	"os"
+)
+
+var (
+	ErrKeysNotSorted = errors.New("lsm-tree: keys must be added in strictly increasing order")
+	ErrEmptyTable    = errors.New("lsm-tree: table has no keys")
+)
+
+// SSTWriter builds a sstable outside of database, which can be added to a
+// database by DB.IngestExternalFiles. cfg should match the database config.
+type SSTWriter struct {
+	f   *os.File
+	w   *sstable.TableWriter
+	cmp compare.Comparator
+
+	lastKey []byte
+	num     int
+}
+
+func NewSSTWriter(path string, cfg *Config) (*SSTWriter, error) {
+	cfg = cfg.sanitize()
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &SSTWriter{
+		f:   f,
+		w:   sstable.NewTableWriter(f, cfg.tableOptions()),
+		cmp: cfg.Comparator,
+	}, nil
+}
+
+// Put add a key-value pair, key must be greater than the previous one
+func (w *SSTWriter) Put(key, val []byte) error {
+	if w.num > 0 && w.cmp.Compare(w.lastKey, key) >= 0 {
+		return ErrKeysNotSorted
+	}
+	w.lastKey = append(w.lastKey[:0], key...)
+	w.num += 1
+
+	w.w.Append(append([]byte(nil), key...), encodeValue(kindValue, val))
+	return nil
+}
+
+// Finish write the table to file and close it
+func (w *SSTWriter) Finish() error {
+	defer w.w.Close()
+
+	if w.num == 0 {
+		return ErrEmptyTable
+	}
+	if _, err := w.w.Flush(); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
+
+// SSTReader reads a sstable written by SSTWriter or by a database
+type SSTReader struct {
+	f *os.File
+	r *sstable.TableReader
+}
+
+func NewSSTReader(path string, cfg *Config) (*SSTReader, error) {
+	cfg = cfg.sanitize()
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	r, err := sstable.NewTableReader(f, cfg.tableOptions(), uint64(info.Size()), cache.NewLRUCache(int64(BlockCacheCapacity)))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &SSTReader{f: f, r: r}, nil
+}
+
+func (r *SSTReader) Get(key []byte) ([]byte, error) {
+	v, err := r.r.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	_, val, err := decodeValue(v)
+	return val, err
+}
+
+// NewIterator return iterator over the table, values stored in blob files are
+// returned as nil since the reader doesn't know about blob files
+func (r *SSTReader) NewIterator() iterator.Iterator {
+	return &sstIterator{r.r.NewIterator()}
+}
+
+func (r *SSTReader) Close() error {
+	return r.f.Close()
+}
+
+type sstIterator struct {
+	iterator.Iterator
+}
+
+func (i *sstIterator) Value() []byte {
+	kind, val, err := decodeValue(i.Iterator.Value())
+	if err != nil {
+		log.Printf("lsm-tree: %v", err)
+		return nil
+	}
+	if kind != kindValue {
+		return nil
+	}
+	return val
+}
@@ -12,6 +12,10 @@ type BlockBuilder struct {
 	data    bytes.Buffer
 	offsets []uint32
 
+	// build hash index of keys, only for data block
+	hashIndex bool
+	hashes    []uint32
+
 	temp []byte
 }
 
@@ -26,6 +30,9 @@ func NewBlockBuilder() *BlockBuilder {
 
 func (b *BlockBuilder) append(key, val []byte) error {
 	b.offsets = append(b.offsets, uint32(b.data.Len()))
+	if b.hashIndex {
+		b.hashes = append(b.hashes, hash(key))
+	}
 
 	n := binary.PutUvarint(b.temp, uint64(len(key)))
 	n += binary.PutUvarint(b.temp[n:], uint64(len(val)))
@@ -57,7 +64,11 @@ func (b *BlockBuilder) appendIndex(minKey []byte, blockOffset, blockLen int) err
 }
 
 func (b *BlockBuilder) estimateSize() int {
-	return b.data.Len() + 4*len(b.offsets) + 4
+	size := b.data.Len() + 4*len(b.offsets) + 4
+	if b.hashIndex {
+		size += numHashBuckets(len(b.offsets)) + 4
+	}
+	return size
 }
 
 func (b *BlockBuilder) build() *Block {
@@ -66,58 +77,106 @@ func (b *BlockBuilder) build() *Block {
 	copy(data, b.data.Bytes())
 	copy(offset, b.offsets)
 
-	return &Block{data, offset}
-}
-
-func (b *BlockBuilder) reset() {
-	b.data.Reset()
-	b.offsets = b.offsets[:0]
+	block := &Block{data: data, offset: offset}
+	if b.hashIndex {
+		block.data = append(block.data, b.buildHashIndex(block)...)
+	}
+	return block
 }
 
-type FilterBuilder struct {
-	bloom *bloomFilterGenerator
-	buf   *bytes.Buffer
-
-	offsets []uint32
-}
+// buildHashIndex map hash of key to index of entry
+func (b *BlockBuilder) buildHashIndex(block *Block) []byte {
+	n := numHashBuckets(len(b.offsets))
+	buckets := make([]byte, n+4)
+	for i := 0; i < n; i++ {
+		buckets[i] = hashBucketEmpty
+	}
 
-func NewFilterBuilder() *FilterBuilder {
-	buf := make([]byte, 0)
-	return &FilterBuilder{
-		bloom: NewBloomFilterGenerator(),
-		buf:   bytes.NewBuffer(buf),
+	for i, h := range b.hashes {
+		if n == 0 {
+			break
+		}
+		bucket := &buckets[h%uint32(n)]
+		if *bucket == hashBucketEmpty {
+			*bucket = uint8(i)
+		} else if *bucket != hashBucketCollision {
+			// keep the first one if key is duplicated
+			k1, _, _ := block.entry(int(*bucket))
+			k2, _, _ := block.entry(i)
+			if !bytes.Equal(k1, k2) {
+				*bucket = hashBucketCollision
+			}
+		}
 	}
+	binary.BigEndian.PutUint32(buckets[n:], uint32(n))
+	return buckets
 }
 
-func (f *FilterBuilder) addKey(key []byte) {
-	f.bloom.add(key)
+func (b *BlockBuilder) reset() {
+	b.data.Reset()
+	b.offsets = b.offsets[:0]
+	b.hashes = b.hashes[:0]
 }
 
-func (f *FilterBuilder) finish() {
-	f.offsets = append(f.offsets, uint32(f.buf.Len()))
-
-	filterEntry := f.bloom.build()
-	if _, err := f.buf.Write(filterEntry); err != nil {
-		log.Printf("lsm-tree: read block failed: %v", err)
-		return
-	}
-}
+const (
+	hashBucketCollision = 254
+	hashBucketEmpty     = 255
+	// entries per bucket
+	hashUtilRatio = 0.75
+)
 
-func (f *FilterBuilder) build() *Block {
-	return &Block{
-		data:   f.buf.Bytes(),
-		offset: f.offsets,
+// numHashBuckets return 0 if there are too many entries to be indexed by a byte
+func numHashBuckets(numEntries int) int {
+	if numEntries == 0 || numEntries >= hashBucketCollision {
+		return 0
 	}
+	return int(float64(numEntries)/hashUtilRatio) + 1
 }
 
 /*
 block format:
 
 	| len(key1) | len(val1) | key1 | val1 | ... | key1 offset | key2 offset | ... | num of key |
+
+data block with hash index:
+
+	| len(key1) | len(val1) | key1 | val1 | ... | bucket1 | bucket2 | ... | num of buckets | key1 offset | ... | num of key |
+
+each bucket is the index of the only entry hashed to it, or a marker of empty or collision
 */
 type Block struct {
 	data   []byte
 	offset []uint32
+
+	// nil if block has no hash index
+	buckets []byte
+}
+
+// splitHashIndex separate hash index from data of data block
+func (b *Block) splitHashIndex() {
+	if len(b.data) < 4 {
+		return
+	}
+	n := int(binary.BigEndian.Uint32(b.data[len(b.data)-4:]))
+	end := len(b.data) - 4 - n
+	if n == 0 {
+		b.data = b.data[:end]
+		return
+	}
+	b.buckets = b.data[end : end+n]
+	b.data = b.data[:end]
+}
+
+// hashLookup return index of the entry which may be key, ok is false if lookup has to fall back to binary search
+func (b *Block) hashLookup(key []byte) (idx int, ok bool) {
+	switch bucket := b.buckets[hash(key)%uint32(len(b.buckets))]; bucket {
+	case hashBucketEmpty:
+		return -1, true
+	case hashBucketCollision:
+		return 0, false
+	default:
+		return int(bucket), true
+	}
 }
 
 func (b *Block) numEntries() int {
@@ -160,6 +219,16 @@ func (b *Block) seek(cmp compare.Comparator, key []byte) int {
 }
 
 func (b *Block) get(cmp compare.Comparator, key []byte) ([]byte, bool) {
+	if b.buckets != nil {
+		if idx, ok := b.hashLookup(key); ok {
+			ekey, val, exist := b.entry(idx)
+			if !exist || cmp.Compare(ekey, key) != 0 {
+				return nil, false
+			}
+			return val, true
+		}
+	}
+
 	idx := b.seek(cmp, key)
 	ekey, val, _ := b.entry(idx)
 	if cmp.Compare(ekey, key) != 0 {
@@ -280,6 +349,10 @@ type IndexBlockIterator struct {
 	indexBlock *IndexBlock
 
 	curIdx int
+	// skip report whether i'th block can be skipped
+	skip func(i int) bool
+	// entries point to index partitions instead of data blocks
+	partitioned bool
 
 	key, val []byte
 }
@@ -295,11 +368,18 @@ func NewIndexBlockIterator(reader *TableReader, block *IndexBlock) *IndexBlockIt
 
 func (i *IndexBlockIterator) First() {
 	i.curIdx = 0
-	i.key, i.val = i.indexBlock.entry(0)
+	i.skipBlocks()
 }
 
 func (i *IndexBlockIterator) Next() {
 	i.curIdx = min(i.curIdx+1, i.indexBlock.numEntries())
+	i.skipBlocks()
+}
+
+func (i *IndexBlockIterator) skipBlocks() {
+	for i.skip != nil && i.Valid() && i.skip(i.curIdx) {
+		i.curIdx += 1
+	}
 	i.key, i.val = i.indexBlock.entry(i.curIdx)
 }
 
@@ -309,9 +389,10 @@ func (i *IndexBlockIterator) Prev() {
 }
 
 func (i *IndexBlockIterator) Seek(key []byte) {
-	idx := i.indexBlock.seek(i.reader.cmp, key)
+	// key is smaller than all keys, start from first block
+	idx := max(i.indexBlock.seek(i.reader.cmp, key), 0)
 	i.curIdx = idx
-	i.key, i.val = i.indexBlock.entry(idx)
+	i.skipBlocks()
 }
 
 func (i *IndexBlockIterator) Valid() bool {
@@ -331,30 +412,13 @@ func (i *IndexBlockIterator) Get() iterator.Iterator {
 		return nil
 	}
 
-	offset, size := decodeIndexEntry(i.key)
-	b, err := i.reader.readBlock(offset, size)
-	if err != nil {
-		log.Printf("lsm-tree: read block failed: %v", err)
-		return nil
-	}
-	return NewBlockIterator(i.reader.cmp, b)
-}
-
-type FilterBlock struct {
-	block *Block
-	bf    bloomFilter
-}
-
-func (f *FilterBlock) contain(index int, key []byte) bool {
-	if index < 0 || index >= f.block.numEntries() {
-		return false
-	}
-
-	offset, size := f.block.offset[index], uint32(0)
-	if index == f.block.numEntries()-1 {
-		size = uint32(len(f.block.data)) - offset
-	} else {
-		size = f.block.offset[index+1] - f.block.offset[index]
+	if i.partitioned {
+		partition, err := i.reader.indexPartition(i.curIdx)
+		if err != nil {
+			log.Printf("lsm-tree: read index partition failed: %v", err)
+			return nil
+		}
+		return NewIndexBlockIterator(i.reader, partition)
 	}
-	return f.bf.contain(f.block.data[offset:offset+size], key)
+	return i.reader.dataBlockIterator(i.key)
 }
@@ -0,0 +1,44 @@
+package sstable
+
+import (
+	"fmt"
+	"lsm/compare"
+	"testing"
+)
+
+func TestBlockHashIndex(t *testing.T) {
+	cmp := compare.BasicComparator{}
+
+	for _, numKeys := range []int{1, 40, 200, 300} {
+		builder := NewBlockBuilder()
+		builder.hashIndex = true
+		for i := 0; i < numKeys; i++ {
+			key := []byte(fmt.Sprintf("key-%05d", i))
+			builder.append(key, []byte(fmt.Sprintf("val-%v", i)))
+			if i%10 == 0 {
+				// duplicated key, first one wins
+				builder.append(key, []byte("old"))
+			}
+		}
+
+		block := decodeBlock(encodeBlock(builder.build()))
+		block.splitHashIndex()
+		if numKeys < hashBucketCollision && block.buckets == nil {
+			t.Fatalf("expect hash index, num of keys: %v", numKeys)
+		}
+
+		for i := 0; i < numKeys; i++ {
+			val, ok := block.get(cmp, []byte(fmt.Sprintf("key-%05d", i)))
+			if !ok || string(val) != fmt.Sprintf("val-%v", i) {
+				t.Errorf("invalid value of key %v, got: %s", i, val)
+			}
+		}
+		for i := 0; i < numKeys; i++ {
+			if val, ok := block.get(cmp, []byte(fmt.Sprintf("absent-%05d", i))); ok {
+				t.Errorf("expect absent key %v not found, got: %s", i, val)
+			}
+		}
+
+		builder.reset()
+	}
+}
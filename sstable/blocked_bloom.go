@@ -0,0 +1,91 @@
+package sstable
+
+// each key only sets bits in one 64 bytes block, a probe touches only one cache line
+const cacheLineBits = 512
+
+// blockedBloomFilterPolicy trades a slightly higher false positive rate for
+// probes that cost a single cache miss
+type blockedBloomFilterPolicy struct {
+	bitsPerKey int
+	k          uint8
+}
+
+func NewBlockedBloomFilterPolicy(bitsPerKey int) FilterPolicy {
+	k := uint8(float64(bitsPerKey) * 0.69)
+	k = max(k, 1)
+	k = min(k, 30)
+
+	return &blockedBloomFilterPolicy{
+		bitsPerKey: bitsPerKey,
+		k:          k,
+	}
+}
+
+func (p *blockedBloomFilterPolicy) Name() string {
+	return "lsm.BlockedBloomFilter"
+}
+
+func (p *blockedBloomFilterPolicy) NewGenerator() FilterGenerator {
+	return &blockedBloomFilterGenerator{
+		bitsPerKey: p.bitsPerKey,
+		k:          p.k,
+		hashKey:    make([]uint64, 0),
+	}
+}
+
+/*
+filter format:
+
+	| cache line block1 | cache line block2 | ... | k (1 byte) |
+*/
+func (p *blockedBloomFilterPolicy) MayContain(filter, key []byte) bool {
+	nBytes := len(filter) - 1
+	if nBytes < cacheLineBits/8 {
+		return false
+	}
+	k := filter[nBytes]
+	numBlocks := uint32(nBytes / (cacheLineBits / 8))
+
+	h := hash64(key)
+	block := filter[fastRange(uint32(h>>32), numBlocks)*cacheLineBits/8:]
+	h2 := uint32(h)
+	for j := uint8(0); j < k; j++ {
+		// use top 9 bits as position in block
+		h2 *= 0x9e3779b9
+		bitpos := h2 >> 23
+		if block[bitpos/8]&(1<<(bitpos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type blockedBloomFilterGenerator struct {
+	bitsPerKey int
+	k          uint8
+	hashKey    []uint64
+}
+
+func (f *blockedBloomFilterGenerator) Add(key []byte) {
+	f.hashKey = append(f.hashKey, hash64(key))
+}
+
+func (f *blockedBloomFilterGenerator) Generate() []byte {
+	numBlocks := (len(f.hashKey)*f.bitsPerKey + cacheLineBits - 1) / cacheLineBits
+	numBlocks = max(numBlocks, 1)
+	numBytes := numBlocks * cacheLineBits / 8
+
+	bitsList := make([]byte, numBytes+1)
+	bitsList[numBytes] = f.k
+	for _, h := range f.hashKey {
+		block := bitsList[fastRange(uint32(h>>32), uint32(numBlocks))*cacheLineBits/8:]
+		h2 := uint32(h)
+		for j := uint8(0); j < f.k; j++ {
+			h2 *= 0x9e3779b9
+			bitpos := h2 >> 23
+			block[bitpos/8] |= 1 << (bitpos % 8)
+		}
+	}
+	f.hashKey = f.hashKey[:0]
+	return bitsList
+}
@@ -1,43 +1,37 @@
 package sstable
 
-type bloomFilterGenerator struct {
-	k       uint8
-	hashKey []uint32
+// bloomFilterPolicy is a classic bloom filter using double hashing
+type bloomFilterPolicy struct {
+	bitsPerKey int
+	// number of probes
+	k uint8
 }
 
-func NewBloomFilterGenerator() *bloomFilterGenerator {
-	return &bloomFilterGenerator{
-		k:       7, // ln2 * m / n = ln2 * 10
-		hashKey: make([]uint32, 0),
+func NewBloomFilterPolicy(bitsPerKey int) FilterPolicy {
+	// optimal k = ln2 * m / n
+	k := uint8(float64(bitsPerKey) * 0.69)
+	k = max(k, 1)
+	k = min(k, 30)
+
+	return &bloomFilterPolicy{
+		bitsPerKey: bitsPerKey,
+		k:          k,
 	}
 }
 
-func (f *bloomFilterGenerator) add(key []byte) {
-	f.hashKey = append(f.hashKey, hash(key))
+func (p *bloomFilterPolicy) Name() string {
+	return "lsm.BuiltinBloomFilter"
 }
 
-func (f *bloomFilterGenerator) build() []byte {
-	numBits := len(f.hashKey) * int(f.k)
-	numBytes := (numBits + 7) / 8
-	numBits = numBytes * 8
-
-	bitsList := make([]byte, numBytes+1)
-	bitsList[numBytes] = f.k
-	for _, key := range f.hashKey {
-		delta := (key >> 17) | (key << 15)
-		for j := uint8(0); j < f.k; j++ {
-			bitpos := key % uint32(numBits)
-			bitsList[bitpos/8] |= (1 << (bitpos % 8))
-			key += delta
-		}
+func (p *bloomFilterPolicy) NewGenerator() FilterGenerator {
+	return &bloomFilterGenerator{
+		bitsPerKey: p.bitsPerKey,
+		k:          p.k,
+		hashKey:    make([]uint32, 0),
 	}
-	f.hashKey = f.hashKey[:0]
-	return bitsList
 }
 
-type bloomFilter struct{}
-
-func (b *bloomFilter) contain(filter, key []byte) bool {
+func (p *bloomFilterPolicy) MayContain(filter, key []byte) bool {
 	nBytes := len(filter) - 1
 	if nBytes < 1 {
 		return false
@@ -57,3 +51,33 @@ func (b *bloomFilter) contain(filter, key []byte) bool {
 	}
 	return true
 }
+
+type bloomFilterGenerator struct {
+	bitsPerKey int
+	k          uint8
+	hashKey    []uint32
+}
+
+func (f *bloomFilterGenerator) Add(key []byte) {
+	f.hashKey = append(f.hashKey, hash(key))
+}
+
+func (f *bloomFilterGenerator) Generate() []byte {
+	// too small filter has a high false positive rate
+	numBits := max(len(f.hashKey)*f.bitsPerKey, 64)
+	numBytes := (numBits + 7) / 8
+	numBits = numBytes * 8
+
+	bitsList := make([]byte, numBytes+1)
+	bitsList[numBytes] = f.k
+	for _, key := range f.hashKey {
+		delta := (key >> 17) | (key << 15)
+		for j := uint8(0); j < f.k; j++ {
+			bitpos := key % uint32(numBits)
+			bitsList[bitpos/8] |= (1 << (bitpos % 8))
+			key += delta
+		}
+	}
+	f.hashKey = f.hashKey[:0]
+	return bitsList
+}
@@ -0,0 +1,184 @@
+package sstable
+
+import (
+	"bytes"
+	"sync"
+)
+
+// FilterPolicy creates filters that are stored in the table to skip reading blocks
+// which cannot contain a key. Name is recorded in the table, so a reader can pick
+// the matching policy to decode the filter.
+type FilterPolicy interface {
+	Name() string
+	NewGenerator() FilterGenerator
+	// MayContain return false if key is definitely not in the filter
+	MayContain(filter, key []byte) bool
+}
+
+type FilterGenerator interface {
+	Add(key []byte)
+	// Generate return filter of keys added since last call
+	Generate() []byte
+}
+
+var filterPolicies = struct {
+	sync.RWMutex
+	m map[string]FilterPolicy
+}{m: make(map[string]FilterPolicy)}
+
+func init() {
+	RegisterFilterPolicy(NewBloomFilterPolicy(10))
+	RegisterFilterPolicy(NewBlockedBloomFilterPolicy(10))
+	RegisterFilterPolicy(NewRibbonFilterPolicy(10))
+}
+
+// RegisterFilterPolicy make a policy available to decode tables written with it,
+// policy of the same name is replaced
+func RegisterFilterPolicy(p FilterPolicy) {
+	filterPolicies.Lock()
+	filterPolicies.m[p.Name()] = p
+	filterPolicies.Unlock()
+}
+
+// lookupFilterPolicy find policy by name, preferred policy is returned if it matches
+func lookupFilterPolicy(name string, preferred FilterPolicy) FilterPolicy {
+	if name == "" {
+		return nil
+	}
+	if preferred != nil && preferred.Name() == name {
+		return preferred
+	}
+
+	filterPolicies.RLock()
+	defer filterPolicies.RUnlock()
+	return filterPolicies.m[name]
+}
+
+// a filter is generated for every 2 KB range of data block offsets
+const defaultFilterBaseLg = 11
+
+type FilterBuilder struct {
+	policy FilterPolicy
+	gen    FilterGenerator
+	// build one filter for whole table instead of one per data block
+	full bool
+	// number of keys added since last filter generated
+	pending int
+
+	// prefix of keys are added to filter as well if not nil
+	prefix     PrefixExtractor
+	lastPrefix []byte
+	hasPrefix  bool
+
+	buf     []byte
+	offsets []uint32
+}
+
+func NewFilterBuilder(policy FilterPolicy, full bool, prefix PrefixExtractor) *FilterBuilder {
+	f := &FilterBuilder{
+		policy: policy,
+		full:   full,
+		prefix: prefix,
+		buf:    make([]byte, 0),
+	}
+	if policy != nil {
+		f.gen = policy.NewGenerator()
+	}
+	return f
+}
+
+func (f *FilterBuilder) addKey(key []byte) {
+	if f.gen == nil {
+		return
+	}
+	f.gen.Add(key)
+	f.pending += 1
+
+	if f.prefix == nil || !f.prefix.InDomain(key) {
+		return
+	}
+	// keys are sorted, only add prefix when it changes
+	if p := f.prefix.Transform(key); !f.hasPrefix || !bytes.Equal(p, f.lastPrefix) {
+		f.gen.Add(p)
+		f.lastPrefix = append(f.lastPrefix[:0], p...)
+		f.hasPrefix = true
+	}
+}
+
+// startBlock is called with the offset of next data block, keys added so far
+// belong to the filter of previous data block
+func (f *FilterBuilder) startBlock(blockOffset uint64) {
+	if f.gen == nil || f.full {
+		return
+	}
+
+	index := blockOffset >> defaultFilterBaseLg
+	for index > uint64(len(f.offsets)) {
+		f.appendFilter()
+	}
+}
+
+func (f *FilterBuilder) appendFilter() {
+	f.offsets = append(f.offsets, uint32(len(f.buf)))
+	if f.pending == 0 {
+		// no data block starts in this range, leave filter empty
+		return
+	}
+
+	f.buf = append(f.buf, f.gen.Generate()...)
+	f.pending = 0
+	f.hasPrefix = false
+}
+
+func (f *FilterBuilder) build() *Block {
+	if f.gen != nil && (f.full || f.pending > 0) {
+		f.appendFilter()
+	}
+	return &Block{
+		data:   f.buf,
+		offset: f.offsets,
+	}
+}
+
+/*
+filter block format:
+
+	| filter1 | filter2 | ... | filter1 offset | filter2 offset | ... | num of filters |
+
+per-block filter: i'th filter contains keys of data blocks starting in [i * 2^baseLg, (i+1) * 2^baseLg)
+full filter: only one filter for whole table
+*/
+type FilterBlock struct {
+	block  *Block
+	policy FilterPolicy
+	full   bool
+	baseLg uint8
+}
+
+// contain return false if the key is definitely not in the data block starting at blockOffset
+func (f *FilterBlock) contain(blockOffset uint64, key []byte) bool {
+	if f.policy == nil {
+		// unknown filter, have to read data block
+		return true
+	}
+
+	index := 0
+	if !f.full {
+		index = int(blockOffset >> f.baseLg)
+	}
+	if index >= f.block.numEntries() {
+		// treat as potential match
+		return true
+	}
+
+	offset, size := f.block.offset[index], uint32(0)
+	if index == f.block.numEntries()-1 {
+		size = uint32(len(f.block.data)) - offset
+	} else {
+		size = f.block.offset[index+1] - f.block.offset[index]
+	}
+	if size == 0 {
+		return false
+	}
+	return f.policy.MayContain(f.block.data[offset:offset+size], key)
+}
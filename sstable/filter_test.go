@@ -0,0 +1,80 @@
+package sstable
+
+import (
+	"fmt"
+	"testing"
+)
+
+var filterPolicyConstructors = []struct {
+	name string
+	new  func(bitsPerKey int) FilterPolicy
+}{
+	{"bloom", NewBloomFilterPolicy},
+	{"blocked-bloom", NewBlockedBloomFilterPolicy},
+	{"ribbon", NewRibbonFilterPolicy},
+}
+
+func buildFilter(p FilterPolicy, numKeys int) []byte {
+	gen := p.NewGenerator()
+	for i := 0; i < numKeys; i++ {
+		gen.Add([]byte(fmt.Sprintf("key-%010d", i)))
+	}
+	return gen.Generate()
+}
+
+func TestFilterPolicy(t *testing.T) {
+	for _, c := range filterPolicyConstructors {
+		for _, numKeys := range []int{0, 1, 10, 1000, 20000} {
+			p := c.new(10)
+			filter := buildFilter(p, numKeys)
+
+			for i := 0; i < numKeys; i++ {
+				if key := fmt.Sprintf("key-%010d", i); !p.MayContain(filter, []byte(key)) {
+					t.Fatalf("%v: false negative on key: %v, num of keys: %v", c.name, key, numKeys)
+				}
+			}
+
+			falsePositive := 0
+			for i := 0; i < 10000; i++ {
+				if p.MayContain(filter, []byte(fmt.Sprintf("absent-%010d", i))) {
+					falsePositive += 1
+				}
+			}
+			if numKeys > 0 && falsePositive > 300 {
+				t.Errorf("%v: too many false positive: %v/10000, num of keys: %v", c.name, falsePositive, numKeys)
+			}
+		}
+	}
+}
+
+// BenchmarkFilterPolicy report false positive rate and actual bits per key of each policy,
+// ns/op is the cost of one probe
+func BenchmarkFilterPolicy(b *testing.B) {
+	const numKeys = 100000
+
+	for _, c := range filterPolicyConstructors {
+		for _, bitsPerKey := range []int{6, 10, 16} {
+			b.Run(fmt.Sprintf("%v/bits=%v", c.name, bitsPerKey), func(b *testing.B) {
+				p := c.new(bitsPerKey)
+				filter := buildFilter(p, numKeys)
+
+				probes := make([][]byte, 4096)
+				for i := range probes {
+					probes[i] = []byte(fmt.Sprintf("absent-%010d", i))
+				}
+
+				falsePositive := 0
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if p.MayContain(filter, probes[i%len(probes)]) {
+						falsePositive += 1
+					}
+				}
+				b.StopTimer()
+
+				b.ReportMetric(float64(falsePositive)/float64(b.N)*100, "fp%")
+				b.ReportMetric(float64(len(filter)*8)/numKeys, "bits/key")
+			})
+		}
+	}
+}
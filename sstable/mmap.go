@@ -0,0 +1,57 @@
+package sstable
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var ErrMmapUnsupported = errors.New("mmap is not supported on this platform")
+
+// MmapReader is a read-only memory mapping of a table file. Blocks read through it
+// refer to the mapping directly instead of being copied. TableReader closes it once
+// its last reference is released, so the mapping outlives every iterator holding one.
+type MmapReader struct {
+	data []byte
+}
+
+var _ io.ReaderAt = (*MmapReader)(nil)
+
+func NewMmapReader(f *os.File, size uint64) (*MmapReader, error) {
+	data, err := mmap(f, int(size))
+	if err != nil {
+		return nil, err
+	}
+
+	return &MmapReader{data}, nil
+}
+
+func (m *MmapReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(m.data)) {
+		return 0, fmt.Errorf("read offset %v out of range", off)
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// slice return data in mapping without copy
+func (m *MmapReader) slice(offset, size uint64) ([]byte, error) {
+	if offset+size > uint64(len(m.data)) {
+		return nil, fmt.Errorf("read block out of range, offset: %v, size: %v", offset, size)
+	}
+	return m.data[offset : offset+size : offset+size], nil
+}
+
+// Close unmap the mapping, slices of it mustn't be used afterwards
+func (m *MmapReader) Close() error {
+	if m.data == nil {
+		return nil
+	}
+	err := munmap(m.data)
+	m.data = nil
+	return err
+}
@@ -0,0 +1,32 @@
+package sstable
+
+import "lsm/compare"
+
+type Options struct {
+	Comparator compare.Comparator
+
+	// size of data block, default: 4 KB
+	BlockSize int
+
+	// FilterPolicy is used to build filters when writing, and is preferred to
+	// decode filters when reading. Tables written with other policies are
+	// decoded by registered policies. No filter is built if nil.
+	FilterPolicy FilterPolicy
+	// FullFilter build one filter for the whole table instead of one per data block
+	FullFilter bool
+
+	// PrefixExtractor adds prefix of keys to filters, filters can be used to
+	// skip tables and blocks only if the table is written with the same extractor
+	PrefixExtractor PrefixExtractor
+
+	// PartitionedIndex splits index and filter into partitions of PartitionSize
+	// behind small top-level indexes, partitions are loaded through block cache
+	// on demand. Filter partitions are always full filters of their partition.
+	PartitionedIndex bool
+	// default: BlockSize
+	PartitionSize int
+
+	// DataBlockHashIndex adds a hash index to each data block for point lookups.
+	// It requires keys that compare equal to be bytewise equal.
+	DataBlockHashIndex bool
+}
@@ -0,0 +1,33 @@
+package sstable
+
+import "fmt"
+
+// PrefixExtractor extracts prefix from keys. Prefixes are added to filters, so a
+// scan over keys with the same prefix can skip tables and blocks without it.
+type PrefixExtractor interface {
+	Name() string
+	// InDomain report whether prefix can be extracted from key
+	InDomain(key []byte) bool
+	Transform(key []byte) []byte
+}
+
+type fixedPrefixExtractor struct {
+	n int
+}
+
+// NewFixedPrefixExtractor use first n bytes as prefix, keys shorter than n have no prefix
+func NewFixedPrefixExtractor(n int) PrefixExtractor {
+	return &fixedPrefixExtractor{n}
+}
+
+func (e *fixedPrefixExtractor) Name() string {
+	return fmt.Sprintf("lsm.FixedPrefix.%d", e.n)
+}
+
+func (e *fixedPrefixExtractor) InDomain(key []byte) bool {
+	return len(key) >= e.n
+}
+
+func (e *fixedPrefixExtractor) Transform(key []byte) []byte {
+	return key[:e.n]
+}
@@ -0,0 +1,144 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"sort"
+	"strings"
+)
+
+const (
+	propComparator   = "lsm.comparator"
+	propFilterPolicy = "lsm.filter.policy"
+	propFullFilter   = "lsm.filter.full"
+	propFilterBaseLg = "lsm.filter.base"
+	propPrefix       = "lsm.prefix.extractor"
+	propPartitioned  = "lsm.index.partitioned"
+	propHashIndex    = "lsm.block.hash_index"
+	propNumEntries   = "lsm.num.entries"
+	propRawKeySize   = "lsm.raw.key.size"
+	propRawValueSize = "lsm.raw.value.size"
+	propNumRangeDels = "lsm.num.range_deletions"
+	propRangeDel     = "lsm.range_del.handle"
+	// prefix of properties set by users of TableWriter
+	propUserPrefix = "user."
+)
+
+/*
+properties block format:
+
+	same as data block, each property is stored as a key-value pair
+*/
+type Properties struct {
+	// name of the comparator used to write the table
+	Comparator string
+	// name of the filter policy, empty if table has no filter
+	FilterPolicy string
+	// whether the filter is built for whole table rather than per data block
+	FullFilter bool
+	// per-block filter is generated for every 2^FilterBaseLg bytes of data blocks
+	FilterBaseLg uint8
+	// name of the prefix extractor, empty if prefixes aren't added to filter
+	PrefixExtractor string
+	// whether index and filter are split into partitions behind top-level indexes
+	PartitionedIndex bool
+	// whether data blocks have hash index
+	DataBlockHashIndex bool
+
+	// number of entries, and total size of their keys and values before compression
+	NumEntries   uint64
+	RawKeySize   uint64
+	RawValueSize uint64
+	// number of range tombstones in range deletion block
+	NumRangeDeletions uint64
+	// properties set by TableWriter.SetUserProperty
+	UserProperties map[string][]byte
+
+	// handle of range deletion block, only set if the table has range tombstones
+	rangeDelOffset, rangeDelSize uint64
+}
+
+func (p *Properties) build() *Block {
+	b := NewBlockBuilder()
+	b.append([]byte(propComparator), []byte(p.Comparator))
+	b.append([]byte(propFilterPolicy), []byte(p.FilterPolicy))
+	b.append([]byte(propFullFilter), encodeBool(p.FullFilter))
+	b.append([]byte(propFilterBaseLg), []byte{p.FilterBaseLg})
+	b.append([]byte(propPrefix), []byte(p.PrefixExtractor))
+	b.append([]byte(propPartitioned), encodeBool(p.PartitionedIndex))
+	b.append([]byte(propHashIndex), encodeBool(p.DataBlockHashIndex))
+	b.append([]byte(propNumEntries), binary.AppendUvarint(nil, p.NumEntries))
+	b.append([]byte(propRawKeySize), binary.AppendUvarint(nil, p.RawKeySize))
+	b.append([]byte(propRawValueSize), binary.AppendUvarint(nil, p.RawValueSize))
+	if p.NumRangeDeletions > 0 {
+		b.append([]byte(propNumRangeDels), binary.AppendUvarint(nil, p.NumRangeDeletions))
+		handle := binary.AppendUvarint(nil, p.rangeDelOffset)
+		b.append([]byte(propRangeDel), binary.AppendUvarint(handle, p.rangeDelSize))
+	}
+	names := make([]string, 0, len(p.UserProperties))
+	for name := range p.UserProperties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b.append([]byte(propUserPrefix+name), p.UserProperties[name])
+	}
+	return b.build()
+}
+
+func decodeProperties(b *Block) *Properties {
+	props := &Properties{}
+	for i := 0; i < b.numEntries(); i++ {
+		key, val, _ := b.entry(i)
+		switch string(key) {
+		case propComparator:
+			props.Comparator = string(val)
+		case propFilterPolicy:
+			props.FilterPolicy = string(val)
+		case propFullFilter:
+			props.FullFilter = decodeBool(val)
+		case propFilterBaseLg:
+			if len(val) > 0 {
+				props.FilterBaseLg = val[0]
+			}
+		case propPrefix:
+			props.PrefixExtractor = string(val)
+		case propPartitioned:
+			props.PartitionedIndex = decodeBool(val)
+		case propHashIndex:
+			props.DataBlockHashIndex = decodeBool(val)
+		case propNumEntries:
+			props.NumEntries, _ = binary.Uvarint(val)
+		case propRawKeySize:
+			props.RawKeySize, _ = binary.Uvarint(val)
+		case propRawValueSize:
+			props.RawValueSize, _ = binary.Uvarint(val)
+		case propNumRangeDels:
+			props.NumRangeDeletions, _ = binary.Uvarint(val)
+		case propRangeDel:
+			var n int
+			props.rangeDelOffset, n = binary.Uvarint(val)
+			if n > 0 {
+				props.rangeDelSize, _ = binary.Uvarint(val[n:])
+			}
+		default:
+			if name, ok := strings.CutPrefix(string(key), propUserPrefix); ok {
+				if props.UserProperties == nil {
+					props.UserProperties = make(map[string][]byte)
+				}
+				props.UserProperties[name] = append([]byte(nil), val...)
+			}
+		}
+	}
+	return props
+}
+
+func encodeBool(b bool) []byte {
+	if b {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+func decodeBool(b []byte) bool {
+	return len(b) > 0 && b[0] == 1
+}
@@ -1,6 +1,7 @@
 package sstable
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -8,21 +9,44 @@ import (
 	"lsm/compare"
 	"lsm/iterator"
 	cache "lsm/lru-cache"
+	"sync/atomic"
 )
 
 func ErrorNotFound(key []byte) error {
 	return fmt.Errorf("key: %v not found", key)
 }
 
+func ErrComparatorMismatch(tableCmp, cmp string) error {
+	return fmt.Errorf("table was written with comparator %q, but read with comparator %q", tableCmp, cmp)
+}
+
+const footerSize = 24
+
 /*
 table format:
 
-	| block1 | block2 | .. | filter block | index block | filter block offset | filter block len | index block offset | index block len |
+	| block1 | block2 | .. | filter block | index block | range deletion block | properties block |
+	| filter block offset | filter block len | index block offset | index block len | properties block offset | properties block len |
+
+partitioned index format:
+
+	| block1 | block2 | .. | filter partition1 | .. | top-level filter index | index partition1 | .. | top-level index | properties block | footer |
+
+top-level indexes have the same format as index block, each entry points to a partition
+instead of a data block. Filter partitions are aligned with index partitions.
+
+range deletion block has the same format as data block, each range tombstone is stored
+with start key as key and end key as value. It's only written if the table has range
+tombstones, its handle is recorded in properties block.
 */
 type TableWriter struct {
 	block       *BlockBuilder
 	indexBlock  *BlockBuilder
 	filterBlock *FilterBuilder
+	rangeDel    *BlockBuilder
+
+	props Properties
+	opts  *Options
 
 	firstKey []byte
 	offset   int
@@ -30,17 +54,48 @@ type TableWriter struct {
 	// default: 4 KB
 	blockSize int
 
+	// finished partitions, only used for partitioned index
+	partitions        []partition
+	partitionFirstKey []byte
+
 	writer io.WriteCloser
 }
 
-func NewTableWriter(writer io.WriteCloser, blockSize int) *TableWriter {
+type partition struct {
+	firstKey []byte
+	index    *Block
+	filter   *Block
+}
+
+func NewTableWriter(writer io.WriteCloser, opts *Options) *TableWriter {
+	props := Properties{
+		Comparator:       opts.Comparator.Name(),
+		FullFilter:       opts.FullFilter || opts.PartitionedIndex,
+		FilterBaseLg:     defaultFilterBaseLg,
+		PartitionedIndex: opts.PartitionedIndex,
+
+		DataBlockHashIndex: opts.DataBlockHashIndex,
+	}
+	if opts.FilterPolicy != nil {
+		props.FilterPolicy = opts.FilterPolicy.Name()
+		if opts.PrefixExtractor != nil {
+			props.PrefixExtractor = opts.PrefixExtractor.Name()
+		}
+	}
+
+	block := NewBlockBuilder()
+	block.hashIndex = opts.DataBlockHashIndex
+
 	return &TableWriter{
-		block:       NewBlockBuilder(),
+		block:       block,
 		indexBlock:  NewBlockBuilder(),
-		filterBlock: NewFilterBuilder(),
+		rangeDel:    NewBlockBuilder(),
+		filterBlock: NewFilterBuilder(opts.FilterPolicy, props.FullFilter, opts.PrefixExtractor),
+		props:       props,
+		opts:        opts,
 		firstKey:    nil,
 		offset:      0,
-		blockSize:   blockSize,
+		blockSize:   opts.BlockSize,
 		writer:      writer,
 	}
 }
@@ -52,6 +107,9 @@ func (s *TableWriter) Append(key, val []byte) {
 
 	s.block.append(key, val)
 	s.filterBlock.addKey(key)
+	s.props.NumEntries += 1
+	s.props.RawKeySize += uint64(len(key))
+	s.props.RawValueSize += uint64(len(val))
 
 	if s.block.estimateSize() >= s.blockSize {
 		s.finishBlock()
@@ -66,21 +124,109 @@ func (s *TableWriter) finishBlock() error {
 		return err
 	}
 
-	s.filterBlock.finish()
-
+	if s.opts.PartitionedIndex && s.partitionFirstKey == nil {
+		s.partitionFirstKey = append([]byte(nil), s.firstKey...)
+	}
 	s.indexBlock.appendIndex(s.firstKey, s.offset, n)
 
 	s.offset += n
+	s.filterBlock.startBlock(uint64(s.offset))
 	s.reset()
 
+	if s.opts.PartitionedIndex && s.indexBlock.estimateSize() >= s.partitionSize() {
+		s.finishPartition()
+	}
 	return nil
 }
 
+func (s *TableWriter) partitionSize() int {
+	if s.opts.PartitionSize > 0 {
+		return s.opts.PartitionSize
+	}
+	return s.blockSize
+}
+
+// finishPartition cut index entries and filter of data blocks since last partition
+func (s *TableWriter) finishPartition() {
+	p := partition{
+		firstKey: s.partitionFirstKey,
+		index:    s.indexBlock.build(),
+	}
+	if s.opts.FilterPolicy != nil {
+		p.filter = s.filterBlock.build()
+		s.filterBlock = NewFilterBuilder(s.opts.FilterPolicy, true, s.opts.PrefixExtractor)
+	}
+	s.partitions = append(s.partitions, p)
+
+	s.indexBlock.reset()
+	s.partitionFirstKey = nil
+}
+
 func (s *TableWriter) reset() {
 	s.block.reset()
 	s.firstKey = nil
 }
 
+// write append block to file and return its offset and len
+func (s *TableWriter) write(b *Block) (offset, n int, err error) {
+	offset = s.offset
+	if n, err = s.writer.Write(encodeBlock(b)); err != nil {
+		return 0, 0, err
+	}
+	s.offset += n
+	return offset, n, nil
+}
+
+// writePartitions write partitions and return top-level filter index and index
+func (s *TableWriter) writePartitions() (filterIndex, index *Block, err error) {
+	if s.partitionFirstKey != nil {
+		s.finishPartition()
+	}
+
+	filterIndexBuilder := NewBlockBuilder()
+	for _, p := range s.partitions {
+		if p.filter == nil {
+			continue
+		}
+		off, n, err := s.write(p.filter)
+		if err != nil {
+			return nil, nil, err
+		}
+		filterIndexBuilder.appendIndex(p.firstKey, off, n)
+	}
+
+	indexBuilder := NewBlockBuilder()
+	for _, p := range s.partitions {
+		off, n, err := s.write(p.index)
+		if err != nil {
+			return nil, nil, err
+		}
+		indexBuilder.appendIndex(p.firstKey, off, n)
+	}
+	return filterIndexBuilder.build(), indexBuilder.build(), nil
+}
+
+// Properties return properties gathered so far
+func (s *TableWriter) Properties() *Properties {
+	return &s.props
+}
+
+// SetUserProperty record a property in properties block of the table, it must be set
+// before Flush
+func (s *TableWriter) SetUserProperty(name string, val []byte) {
+	if s.props.UserProperties == nil {
+		s.props.UserProperties = make(map[string][]byte)
+	}
+	s.props.UserProperties[name] = val
+}
+
+// AddRangeTombstone add a tombstone deleting keys in [start, end), tombstones must be
+// added in order of start key
+func (s *TableWriter) AddRangeTombstone(start, end []byte) {
+	s.rangeDel.append(start, end)
+	s.props.NumRangeDeletions += 1
+}
+
 // Write sstable to file
 func (s *TableWriter) Flush() (tableSize uint64, err error) {
 	if s.firstKey != nil {
@@ -89,39 +235,58 @@ func (s *TableWriter) Flush() (tableSize uint64, err error) {
 		}
 	}
 
-	filterBlock := s.filterBlock.build()
-	encFilterBlock := encodeBlock(filterBlock)
-	n1, err := s.writer.Write(encFilterBlock)
+	var filterBlock, indexBlock *Block
+	if s.opts.PartitionedIndex {
+		if filterBlock, indexBlock, err = s.writePartitions(); err != nil {
+			return 0, err
+		}
+	} else {
+		filterBlock, indexBlock = s.filterBlock.build(), s.indexBlock.build()
+	}
+
+	off1, n1, err := s.write(filterBlock)
 	if err != nil {
 		return 0, err
 	}
-
-	indexBlock := s.indexBlock.build()
-	encIndexBlock := encodeBlock(indexBlock)
-	n2, err := s.writer.Write(encIndexBlock)
+	off2, n2, err := s.write(indexBlock)
+	if err != nil {
+		return 0, err
+	}
+	if s.props.NumRangeDeletions > 0 {
+		off, n, err := s.write(s.rangeDel.build())
+		if err != nil {
+			return 0, err
+		}
+		s.props.rangeDelOffset, s.props.rangeDelSize = uint64(off), uint64(n)
+	}
+	off3, n3, err := s.write(s.props.build())
 	if err != nil {
 		return 0, err
 	}
 
-	footer := make([]byte, 16)
+	footer := make([]byte, footerSize)
 	// offset of filter block
-	binary.BigEndian.PutUint32(footer[0:4], uint32(s.offset))
+	binary.BigEndian.PutUint32(footer[0:4], uint32(off1))
 	// len of filter block
 	binary.BigEndian.PutUint32(footer[4:8], uint32(n1))
 	// offset of index block
-	binary.BigEndian.PutUint32(footer[8:12], uint32(s.offset+n1))
+	binary.BigEndian.PutUint32(footer[8:12], uint32(off2))
 	// len of index block
 	binary.BigEndian.PutUint32(footer[12:16], uint32(n2))
+	// offset of properties block
+	binary.BigEndian.PutUint32(footer[16:20], uint32(off3))
+	// len of properties block
+	binary.BigEndian.PutUint32(footer[20:24], uint32(n3))
 
 	if _, err = s.writer.Write(footer); err != nil {
 		return 0, err
 	}
 
-	return uint64(s.offset + n1 + n2 + 16), nil
+	return uint64(s.offset + footerSize), nil
 }
 
 func (s *TableWriter) EstimateSize() int {
-	return s.offset + s.block.estimateSize() + s.indexBlock.estimateSize()
+	return s.offset + s.block.estimateSize() + s.indexBlock.estimateSize() + s.rangeDel.estimateSize()
 }
 
 func (s *TableWriter) Close() {
@@ -132,26 +297,53 @@ type TableReader struct {
 	r    io.ReaderAt
 	size uint64
 
-	cmp compare.Comparator
+	cmp  compare.Comparator
+	opts *Options
 
-	indexBlock  *IndexBlock
+	// top-level index if index is partitioned
+	indexBlock *IndexBlock
+	// nil if index is partitioned
 	filterBlock *FilterBlock
+	// top-level filter index, only for partitioned index
+	filterIndex  *IndexBlock
+	filterPolicy FilterPolicy
+	props        *Properties
+	// range tombstones sorted by start key
+	rangeDels []iterator.RangeTombstone
 
 	blockCache cache.Cache
+
+	// underlying reader is closed once references drop to 0
+	refs atomic.Int32
 }
 
-func NewTableReader(r io.ReaderAt, cmp compare.Comparator, tableSize uint64, blockCache cache.Cache) (*TableReader, error) {
+func NewTableReader(r io.ReaderAt, opts *Options, tableSize uint64, blockCache cache.Cache) (*TableReader, error) {
+	cmp := opts.Comparator
 	reader := &TableReader{
 		r:          r,
 		cmp:        cmp,
+		opts:       opts,
 		size:       tableSize,
 		blockCache: blockCache,
 	}
+	reader.refs.Store(1)
+
+	footer := make([]byte, footerSize)
+	if _, err := r.ReadAt(footer, int64(tableSize-footerSize)); err != nil {
+		return nil, err
+	}
 
-	footer := make([]byte, 16)
-	if _, err := r.ReadAt(footer, int64(tableSize-16)); err != nil {
+	propsOffset := binary.BigEndian.Uint32(footer[16:20])
+	propsSize := binary.BigEndian.Uint32(footer[20:24])
+	propsBlock, err := reader.readBlock(uint64(propsOffset), uint64(propsSize))
+	if err != nil {
 		return nil, err
 	}
+	reader.props = decodeProperties(propsBlock)
+	if reader.props.Comparator != cmp.Name() {
+		return nil, ErrComparatorMismatch(reader.props.Comparator, cmp.Name())
+	}
+	reader.filterPolicy = lookupFilterPolicy(reader.props.FilterPolicy, opts.FilterPolicy)
 
 	filterOffset := binary.BigEndian.Uint32(footer[:4])
 	filterSize := binary.BigEndian.Uint32(footer[4:8])
@@ -159,9 +351,15 @@ func NewTableReader(r io.ReaderAt, cmp compare.Comparator, tableSize uint64, blo
 	if err != nil {
 		return nil, err
 	}
-	reader.filterBlock = &FilterBlock{
-		block: filterBlock,
-		bf:    bloomFilter{},
+	if reader.props.PartitionedIndex {
+		reader.filterIndex = &IndexBlock{filterBlock}
+	} else {
+		reader.filterBlock = &FilterBlock{
+			block:  filterBlock,
+			policy: reader.filterPolicy,
+			full:   reader.props.FullFilter,
+			baseLg: reader.props.FilterBaseLg,
+		}
 	}
 
 	idxOffset := binary.BigEndian.Uint32(footer[8:12])
@@ -172,22 +370,144 @@ func NewTableReader(r io.ReaderAt, cmp compare.Comparator, tableSize uint64, blo
 	}
 	reader.indexBlock = &IndexBlock{idxBlock}
 
+	if reader.props.NumRangeDeletions > 0 {
+		rangeDelBlock, err := reader.readBlock(reader.props.rangeDelOffset, reader.props.rangeDelSize)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < rangeDelBlock.numEntries(); i++ {
+			// copied, since block may refer to memory mapping
+			start, end, _ := rangeDelBlock.entry(i)
+			reader.rangeDels = append(reader.rangeDels, iterator.RangeTombstone{
+				Start: append([]byte(nil), start...),
+				End:   append([]byte(nil), end...),
+			})
+		}
+	}
+
 	return reader, nil
 }
 
-func (r *TableReader) Get(key []byte) ([]byte, error) {
+// Ref add a reference to reader, it fails if reader is closed already. Keys and values
+// returned by iterators of reader are valid until the reference is released, since they
+// may refer to memory mapping.
+func (r *TableReader) Ref() bool {
+	for {
+		refs := r.refs.Load()
+		if refs <= 0 {
+			return false
+		}
+		if r.refs.CompareAndSwap(refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// Unref release a reference, the reference returned by NewTableReader included. Underlying
+// reader is closed if it's an io.Closer once no reference is left.
+func (r *TableReader) Unref() {
+	if r.refs.Add(-1) != 0 {
+		return
+	}
+	if c, ok := r.r.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Printf("lsm-tree: close table err: %v", err)
+		}
+	}
+}
+
+// RangeTombstones return range tombstones of the table sorted by start key
+func (r *TableReader) RangeTombstones() []iterator.RangeTombstone {
+	return r.rangeDels
+}
+
+// Properties return the table-level metadata written by TableWriter
+func (r *TableReader) Properties() *Properties {
+	return r.props
+}
+
+// indexPartition load i'th index partition through block cache
+func (r *TableReader) indexPartition(i int) (*IndexBlock, error) {
+	desc, _ := r.indexBlock.entry(i)
+	if desc == nil {
+		return nil, fmt.Errorf("index partition %v not found", i)
+	}
+	b, err := r.readBlock(decodeIndexEntry(desc))
+	if err != nil {
+		return nil, err
+	}
+	return &IndexBlock{b}, nil
+}
+
+// partitionMayContain check filter of i'th partition
+func (r *TableReader) partitionMayContain(i int, key []byte) bool {
+	if r.filterPolicy == nil {
+		return true
+	}
+	desc, _ := r.filterIndex.entry(i)
+	if desc == nil {
+		return true
+	}
+	b, err := r.readBlock(decodeIndexEntry(desc))
+	if err != nil {
+		return true
+	}
+	f := &FilterBlock{block: b, policy: r.filterPolicy, full: true}
+	return f.contain(0, key)
+}
+
+// blockHandle return offset and size of the data block which key might fall in,
+// and the index partition it belongs to
+func (r *TableReader) blockHandle(key []byte) (offset, size uint64, partition int, ok bool) {
 	idx := r.indexBlock.seek(r.cmp, key)
-	if exist := r.filterBlock.contain(idx, key); !exist {
-		return nil, ErrorNotFound(key)
+	if idx < 0 {
+		return 0, 0, 0, false
+	}
+
+	indexBlock := r.indexBlock
+	if r.props.PartitionedIndex {
+		var err error
+		if indexBlock, err = r.indexPartition(idx); err != nil {
+			log.Printf("lsm-tree: read index partition failed: %v", err)
+			return 0, 0, 0, false
+		}
+		partition, idx = idx, indexBlock.seek(r.cmp, key)
 	}
 
-	desc, _ := r.indexBlock.entry(idx)
+	desc, _ := indexBlock.entry(idx)
 	if desc == nil {
+		return 0, 0, 0, false
+	}
+	offset, size = decodeIndexEntry(desc)
+	return offset, size, partition, true
+}
+
+// mayContain check filter of the data block which key might fall in
+func (r *TableReader) mayContain(blockOffset uint64, partition int, key []byte) bool {
+	if r.props.PartitionedIndex {
+		return r.partitionMayContain(partition, key)
+	}
+	return r.filterBlock.contain(blockOffset, key)
+}
+
+// MayContain return false if key is definitely not in table, no data block is read
+func (r *TableReader) MayContain(key []byte) bool {
+	if r.props.PartitionedIndex {
+		// filter is checked before loading index partition
+		idx := r.indexBlock.seek(r.cmp, key)
+		return idx >= 0 && r.partitionMayContain(idx, key)
+	}
+	offset, _, partition, ok := r.blockHandle(key)
+	return ok && r.mayContain(offset, partition, key)
+}
+
+func (r *TableReader) Get(key []byte) ([]byte, error) {
+	off, size, partition, ok := r.blockHandle(key)
+	if !ok || !r.mayContain(off, partition, key) {
 		return nil, ErrorNotFound(key)
 	}
 
-	off, size := decodeIndexEntry(desc)
-	block, err := r.readBlock(off, size)
+	block, err := r.readDataBlock(off, size)
 	if err != nil {
 		return nil, err
 	}
@@ -196,27 +516,149 @@ func (r *TableReader) Get(key []byte) ([]byte, error) {
 	if !ok {
 		return nil, ErrorNotFound(key)
 	}
-	return val, nil
+	// value may refer to block cache or mmap
+	return append([]byte(nil), val...), nil
 }
 
 func (r *TableReader) NewIterator() iterator.Iterator {
+	return iterator.NewTwoLevelIterator(r.newIndexIterator(nil))
+}
+
+// newIndexIterator return iterator over data blocks, blocks or partitions are skipped if skip return true
+func (r *TableReader) newIndexIterator(skip func(i int) bool) iterator.IndexIterator {
 	indexIter := NewIndexBlockIterator(r, r.indexBlock)
+	indexIter.skip = skip
+	if !r.props.PartitionedIndex {
+		indexIter.First()
+		return indexIter
+	}
 
-	return iterator.NewTwoLevelIterator(indexIter)
+	indexIter.partitioned = true
+	return &partitionedIndexIterator{
+		TwoLevelIterator: iterator.NewTwoLevelIterator(indexIter),
+		reader:           r,
+	}
+}
+
+// canFilterPrefix report whether filters can tell if keys with prefix exist
+func (r *TableReader) canFilterPrefix(prefix []byte) bool {
+	pe := r.opts.PrefixExtractor
+	if pe == nil || r.filterPolicy == nil || r.props.PrefixExtractor != pe.Name() {
+		return false
+	}
+	return pe.InDomain(prefix) && bytes.Equal(pe.Transform(prefix), prefix)
+}
+
+// MayContainPrefix return false if there is definitely no key with prefix in table
+func (r *TableReader) MayContainPrefix(prefix []byte) bool {
+	if !r.canFilterPrefix(prefix) {
+		return true
+	}
+	if !r.props.PartitionedIndex && r.filterBlock.full {
+		return r.filterBlock.contain(0, prefix)
+	}
+
+	// only blocks or partitions that overlap with prefix
+	start := max(r.indexBlock.seek(r.cmp, prefix), 0)
+	for i := start; i < r.indexBlock.numEntries(); i++ {
+		_, minKey := r.indexBlock.entry(i)
+		if i > start && !bytes.HasPrefix(minKey, prefix) {
+			break
+		}
+		if r.prefixMayMatch(i, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixMayMatch check filter of i'th entry of index block, which is a partition if index is partitioned
+func (r *TableReader) prefixMayMatch(i int, prefix []byte) bool {
+	if r.props.PartitionedIndex {
+		return r.partitionMayContain(i, prefix)
+	}
+	desc, _ := r.indexBlock.entry(i)
+	offset, _ := decodeIndexEntry(desc)
+	return r.filterBlock.contain(offset, prefix)
+}
+
+// NewPrefixIterator return iterator that skips data blocks whose filter rules out prefix,
+// keys without prefix may still be returned from other blocks
+func (r *TableReader) NewPrefixIterator(prefix []byte) iterator.Iterator {
+	var skip func(i int) bool
+	if r.canFilterPrefix(prefix) && (r.props.PartitionedIndex || !r.filterBlock.full) {
+		skip = func(i int) bool {
+			return !r.prefixMayMatch(i, prefix)
+		}
+	}
+
+	return iterator.NewTwoLevelIterator(r.newIndexIterator(skip))
 }
 
 func (r *TableReader) readBlock(offset, size uint64) (*Block, error) {
+	return r.readBlockWith(offset, size, false)
+}
+
+// readDataBlock is readBlock that also decodes hash index if table has one
+func (r *TableReader) readDataBlock(offset, size uint64) (*Block, error) {
+	return r.readBlockWith(offset, size, r.props.DataBlockHashIndex)
+}
+
+func (r *TableReader) readBlockWith(offset, size uint64, hashIndex bool) (*Block, error) {
+	// block refers to the mapping directly, no need to cache it
+	if m, ok := r.r.(*MmapReader); ok {
+		data, err := m.slice(offset, size)
+		if err != nil {
+			return nil, err
+		}
+		b := decodeBlock(data)
+		if hashIndex {
+			b.splitHashIndex()
+		}
+		return b, nil
+	}
+
 	block := r.blockCache.Get(offset, func() (interface{}, int64) {
 		data := make([]byte, size)
 		if _, err := r.r.ReadAt(data, int64(offset)); err != nil {
 			log.Printf("lsm-tree: read block failed: %v", err)
 			return nil, 0
 		}
-		return decodeBlock(data), int64(len(data))
+		b := decodeBlock(data)
+		if hashIndex {
+			b.splitHashIndex()
+		}
+		return b, int64(len(data))
 	})
 
 	if block == nil {
+		r.blockCache.Remove(offset)
 		return nil, fmt.Errorf("read block error")
 	}
 	return block.(*Block), nil
 }
+
+// dataBlockIterator return iterator of data block described by index entry
+func (r *TableReader) dataBlockIterator(desc []byte) iterator.Iterator {
+	b, err := r.readDataBlock(decodeIndexEntry(desc))
+	if err != nil {
+		log.Printf("lsm-tree: read block failed: %v", err)
+		return nil
+	}
+	return NewBlockIterator(r.cmp, b)
+}
+
+// partitionedIndexIterator iterates index entries across all index partitions
+type partitionedIndexIterator struct {
+	*iterator.TwoLevelIterator
+	reader *TableReader
+}
+
+var _ iterator.IndexIterator = (*partitionedIndexIterator)(nil)
+
+func (i *partitionedIndexIterator) Get() iterator.Iterator {
+	if !i.Valid() {
+		return nil
+	}
+	return i.reader.dataBlockIterator(i.Key())
+}
@@ -89,3 +89,32 @@ func hash(data []byte) uint32 {
 
 	return h
 }
+
+// hash64 is 64-bit FNV-1a with a finalizer to spread entropy to all bits
+func hash64(data []byte) uint64 {
+	const (
+		offset = uint64(14695981039346656037)
+		prime  = uint64(1099511628211)
+	)
+	h := offset
+	for _, b := range data {
+		h ^= uint64(b)
+		h *= prime
+	}
+	return mix64(h)
+}
+
+// mix64 is the finalizer of splitmix64
+func mix64(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+// fastRange map h to [0, n) without division
+func fastRange(h uint32, n uint32) uint32 {
+	return uint32((uint64(h) * uint64(n)) >> 32)
+}
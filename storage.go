@@ -1,14 +1,22 @@
 package lsm
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"lsm/compare"
 	"lsm/iterator"
 	cache "lsm/lru-cache"
 	"lsm/sstable"
+	"os"
 	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // tWriter is wrapper of sstable.TableWriter
@@ -17,6 +25,10 @@ type tWriter struct {
 	w  *sstable.TableWriter
 
 	minKey, maxKey []byte
+
+	// recorded in table properties
+	numDeletions uint64
+	largestSeq   uint64
 }
 
 func (t *tWriter) estimateSize() int {
@@ -28,11 +40,34 @@ func (t *tWriter) append(key, val []byte) {
 		t.minKey = append([]byte(nil), key...)
 	}
 	t.maxKey = append([]byte(nil), key...)
+	if isDeletion(val) {
+		t.numDeletions += 1
+	}
 
 	t.w.Append(key, val)
 }
 
+// addRangeTombstones add tombstones sorted by start key after all keys are appended, key
+// range of table is extended to cover them
+func (t *tWriter) addRangeTombstones(cmp compare.Comparator, ts []iterator.RangeTombstone) {
+	for _, rt := range ts {
+		if t.minKey == nil || cmp.Compare(rt.Start, t.minKey) < 0 {
+			t.minKey = append([]byte(nil), rt.Start...)
+		}
+		if t.maxKey == nil || cmp.Compare(rt.End, t.maxKey) > 0 {
+			t.maxKey = append([]byte(nil), rt.End...)
+		}
+		t.numDeletions += 1
+
+		t.w.AddRangeTombstone(rt.Start, rt.End)
+	}
+}
+
 func (t *tWriter) finish() (*table, error) {
+	t.w.SetUserProperty(propNumDeletions, binary.AppendUvarint(nil, t.numDeletions))
+	t.w.SetUserProperty(propLargestSeq, binary.AppendUvarint(nil, t.largestSeq))
+	props := newTableProps(t.w.Properties())
+
 	size, err := t.w.Flush()
 	if err != nil {
 		return nil, err
@@ -40,21 +75,77 @@ func (t *tWriter) finish() (*table, error) {
 	t.w.Close()
 
 	tt := &table{
-		id:     t.id,
-		size:   size,
-		minKey: t.minKey,
-		maxKey: t.maxKey,
+		id:        t.id,
+		size:      size,
+		createdAt: time.Now().Unix(),
+		minKey:    t.minKey,
+		maxKey:    t.maxKey,
 	}
+	tt.props.Store(props)
 	return tt, nil
 }
 
 type table struct {
 	id   uint64
 	size uint64
+	// global sequence number of ingested table, 0 for tables written by database. It isn't
+	// used for read precedence, which comes from position of table in levels.
+	seqNum uint64
+	// unix time when table is written or ingested
+	createdAt int64
+	// lookups that read the table but found key in a later table
+	seeks atomic.Int64
+	// loaded from table properties on demand, see Storage.tableProps
+	props atomic.Pointer[tableProps]
+	// number of versions referring to table, guarded by Storage.mu. File of table is removed
+	// once it's obsolete, i.e. deleted from levels, and no version refers to it.
+	refs     int
+	obsolete bool
 
 	minKey, maxKey []byte
 }
 
+// contain report whether key is in the range of table
+func (t *table) contain(cmp compare.Comparator, key []byte) bool {
+	return cmp.Compare(t.minKey, key) <= 0 && cmp.Compare(t.maxKey, key) >= 0
+}
+
+// allowedSeeks return number of wasted seeks after which table is compacted. Reading a
+// table costs about as much as compacting SeekCostBytes of it.
+func (t *table) allowedSeeks() int64 {
+	n := int64(t.size) / int64(SeekCostBytes)
+	if n < int64(MinAllowedSeeks) {
+		n = int64(MinAllowedSeeks)
+	}
+	return n
+}
+
+const (
+	propNumDeletions = "lsm.num.deletions"
+	propLargestSeq   = "lsm.largest.seq"
+)
+
+// tableProps are gathered when table is built
+type tableProps struct {
+	numEntries   uint64
+	numDeletions uint64
+	rawKeySize   uint64
+	rawValueSize uint64
+	// sequence number of the newest flush or ingestion whose data is in the table
+	largestSeq uint64
+}
+
+func newTableProps(p *sstable.Properties) *tableProps {
+	props := &tableProps{
+		numEntries:   p.NumEntries,
+		rawKeySize:   p.RawKeySize,
+		rawValueSize: p.RawValueSize,
+	}
+	props.numDeletions, _ = binary.Uvarint(p.UserProperties[propNumDeletions])
+	props.largestSeq, _ = binary.Uvarint(p.UserProperties[propLargestSeq])
+	return props
+}
+
 func (t *table) getTableName() string {
 	return fileName(SstableFile, t.id)
 }
@@ -65,8 +156,23 @@ func (t tables) Len() int                    { return len(t) }
 func (t tables) Swap(i, j int)               { t[i], t[j] = t[j], t[i] }
 func (t tables) sort(cmp compare.Comparator) { sort.Sort(tablesSorter{t, cmp}) }
 
-func (t tables) newIndexIterator(s *Storage, cmp compare.Comparator) iterator.IndexIterator {
-	return newLevelFilesIterator(s, t, cmp)
+func (t tables) newIndexIterator(refs *tableRefs, cmp compare.Comparator) iterator.IndexIterator {
+	return newLevelFilesIterator(refs, t, cmp)
+}
+
+// overlapPrefix return tables that may contain keys with prefix, comparator should be
+// compare.PrefixOrdered
+func (t tables) overlapPrefix(cmp compare.Comparator, prefix []byte) tables {
+	ts := make(tables, 0)
+	for _, table := range t {
+		if cmp.Compare(table.maxKey, prefix) < 0 {
+			continue
+		}
+		if cmp.Compare(table.minKey, prefix) <= 0 || bytes.HasPrefix(table.minKey, prefix) {
+			ts = append(ts, table)
+		}
+	}
+	return ts
 }
 
 func (t tables) search(cmp compare.Comparator, key []byte) int {
@@ -90,15 +196,15 @@ func (t tablesSorter) Less(i, j int) bool {
 }
 
 type levelFilesIterator struct {
-	s   *Storage
-	cmp compare.Comparator
+	refs *tableRefs
+	cmp  compare.Comparator
 
 	tables
 	idx int
 }
 
-func newLevelFilesIterator(s *Storage, ts tables, cmp compare.Comparator) *levelFilesIterator {
-	iter := levelFilesIterator{s, cmp, ts, 0}
+func newLevelFilesIterator(refs *tableRefs, ts tables, cmp compare.Comparator) *levelFilesIterator {
+	iter := levelFilesIterator{refs, cmp, ts, 0}
 	return &iter
 }
 
@@ -120,16 +226,11 @@ func (i *levelFilesIterator) Prev() {
 	i.idx -= 1
 }
 
+// Seek move to the first table that may contain key greater or equal to key
 func (i *levelFilesIterator) Seek(key []byte) {
-	for idx, t := range i.tables {
-		if i.cmp.Compare(t.minKey, key) <= 0 && i.cmp.Compare(t.maxKey, key) >= 0 {
-			i.idx = idx
-			return
-		} else if i.cmp.Compare(t.minKey, key) > 0 {
-			break
-		}
-	}
-	i.idx = -1
+	i.idx = sort.Search(len(i.tables), func(idx int) bool {
+		return i.cmp.Compare(i.tables[idx].maxKey, key) >= 0
+	})
 }
 
 func (i *levelFilesIterator) Valid() bool {
@@ -148,13 +249,45 @@ func (i *levelFilesIterator) Get() iterator.Iterator {
 	if !i.Valid() {
 		return nil
 	}
-	reader, err := i.s.open(i.tables[i.idx])
+	reader, err := i.refs.open(i.tables[i.idx])
 	if err != nil {
 		return nil
 	}
 	return reader.NewIterator()
 }
 
+// tableRefs keep readers opened through it referenced until release, so that keys and
+// values of their iterators stay valid even if tables are evicted from table cache or
+// removed by compaction. It isn't safe for concurrent use.
+type tableRefs struct {
+	s       *Storage
+	readers map[uint64]*sstable.TableReader
+}
+
+func (s *Storage) newTableRefs() *tableRefs {
+	return &tableRefs{s: s, readers: make(map[uint64]*sstable.TableReader)}
+}
+
+func (r *tableRefs) open(t *table) (*sstable.TableReader, error) {
+	if reader, ok := r.readers[t.id]; ok {
+		return reader, nil
+	}
+	reader, err := r.s.open(t)
+	if err != nil {
+		return nil, err
+	}
+	r.readers[t.id] = reader
+	return reader, nil
+}
+
+// release drop references of all opened readers, iterators mustn't be used afterwards
+func (r *tableRefs) release() {
+	for _, reader := range r.readers {
+		reader.Unref()
+	}
+	r.readers = make(map[uint64]*sstable.TableReader)
+}
+
 type Storage struct {
 	db  *DB
 	cmp compare.Comparator
@@ -165,49 +298,196 @@ type Storage struct {
 	mu sync.RWMutex
 
 	nextFileId uint64
+	logNumber  uint64
+	// last sequence number assigned to flushed or ingested tables
+	lastSequence uint64
+	// largest key of last applied compaction of each level, indexed by level
+	compactPointers [][]byte
+	// id of tables being compacted
+	compacting map[uint64]bool
+	// table which used up its allowed seeks, and its level
+	seekCompact      *table
+	seekCompactLevel int
+
+	tableOpts *sstable.Options
+	policy    CompactionPolicy
+
+	// current version of blob files referenced by sstables or memtable
+	blobs *blobVersion
 
 	tableCache cache.Cache
 	blockCache cache.Cache
+	blobCache  cache.Cache
 }
 
-func NewStorage(db *DB) *Storage {
-	if err := createDir(); err != nil {
-		panic(err)
+func NewStorage(db *DB) (*Storage, error) {
+	if err := createDir(db.cfg.Dir); err != nil {
+		return nil, err
 	}
-	return &Storage{
+	// a reader is closed once it's evicted and no iterator refers to it
+	tableCache := cache.NewLRUCacheWithEvict(int64(FileCacheCapacity), func(val interface{}) {
+		val.(*sstable.TableReader).Unref()
+	})
+	blobCache := cache.NewLRUCacheWithEvict(int64(FileCacheCapacity), func(val interface{}) {
+		val.(*blobReader).unref()
+	})
+	s := &Storage{
 		db:         db,
 		cmp:        db.cmp,
 		level0:     make([]*table, 0),
 		levels:     make([]tables, MaximumLevel),
 		mu:         sync.RWMutex{},
-		tableCache: cache.NewLRUCache(int64(FileCacheCapacity)),
+		tableCache: tableCache,
 		blockCache: cache.NewLRUCache(int64(BlockCacheCapacity)),
+		blobCache:  blobCache,
+		blobs:      newBlobVersion(nil),
+
+		compactPointers: make([][]byte, MaximumLevel+1),
+		compacting:      make(map[uint64]bool),
+		tableOpts:       db.cfg.tableOptions(),
+		policy:          db.cfg.CompactionPolicy,
+	}
+
+	m, err := readManifest()
+	if errors.Is(err, fs.ErrNotExist) {
+		// new database
+		return s, s.saveManifest()
+	} else if err != nil {
+		return nil, err
+	}
+
+	if m.comparator != s.cmp.Name() {
+		return nil, fmt.Errorf("lsm-tree: database was created with comparator %q, but opened with comparator %q", m.comparator, s.cmp.Name())
+	}
+
+	s.nextFileId = m.nextFileId
+	s.logNumber = m.logNumber
+	s.lastSequence = m.lastSequence
+	for level, ts := range m.levels {
+		if level == 0 {
+			s.level0 = ts
+			continue
+		}
+		for len(s.levels) < level {
+			s.levels = append(s.levels, tables{})
+		}
+		s.levels[level-1] = ts
+	}
+	files := make(map[uint64]*blobFile, len(m.blobs))
+	for _, bf := range m.blobs {
+		files[bf.id] = bf
+	}
+	s.blobs = newBlobVersion(files)
+	for len(s.compactPointers) <= len(s.levels) {
+		s.compactPointers = append(s.compactPointers, nil)
+	}
+	for level, key := range m.compactPointers {
+		if level < len(s.compactPointers) {
+			s.compactPointers[level] = key
+		}
+	}
+	return s, nil
+}
+
+// saveManifest persist current metadata, caller should hold s.mu
+func (s *Storage) saveManifest() error {
+	m := &manifest{
+		comparator:   s.cmp.Name(),
+		nextFileId:   atomic.LoadUint64(&s.nextFileId),
+		logNumber:    s.logNumber,
+		lastSequence: s.lastSequence,
+		levels:       make([][]*table, 0, len(s.levels)+1),
+	}
+	m.levels = append(m.levels, s.level0)
+	for _, ts := range s.levels {
+		m.levels = append(m.levels, ts)
+	}
+	for _, bf := range s.blobs.files {
+		m.blobs = append(m.blobs, bf)
+	}
+	m.compactPointers = s.compactPointers
+	return writeManifest(m)
+}
+
+// logFiles return journal files which may contain data not yet flushed, sorted by id
+func (s *Storage) logFiles() ([]uint64, error) {
+	entries, err := os.ReadDir(DirectoryPath)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint64, 0)
+	for _, e := range entries {
+		ftype, id, ok := parseFileName(e.Name())
+		if !ok {
+			continue
+		}
+		if id >= s.nextFileId {
+			s.nextFileId = id + 1
+		}
+		if ftype == LogFile && id >= s.logNumber {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// setLogNumber record journal files older than logNumber is useless and remove them
+func (s *Storage) setLogNumber(logNumber uint64) {
+	s.mu.Lock()
+	old := s.logNumber
+	s.logNumber = logNumber
+	if err := s.saveManifest(); err != nil {
+		log.Printf("lsm-tree: save manifest err: %v", err)
+	}
+	s.mu.Unlock()
+
+	for id := old; id < logNumber; id++ {
+		if err := removeFile(fileName(LogFile, id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("lsm-tree: remove useless file err: %v", err)
+		}
 	}
 }
 
 func (s *Storage) get(key []byte) ([]byte, bool) {
-	for i := len(s.level0) - 1; i > -1; i-- {
-		table := s.level0[i]
-		reader, err := s.open(table)
-		if err != nil {
-			return nil, false
+	// tables compacted away during lookup aren't removed until it's done
+	v := s.refVersion()
+	defer s.unrefVersion(v)
+	level0, levels := v.level0, v.levels
+
+	// the first table read is charged if key is searched in more tables
+	var first *table
+	firstLevel, probes := 0, 0
+	probe := func(t *table, level int) ([]byte, bool, error) {
+		if probes += 1; probes == 1 {
+			first, firstLevel = t, level
+		} else if probes == 2 {
+			s.chargeSeek(first, firstLevel)
 		}
-		if val, err := reader.Get(key); err == nil {
-			return val, true
+		return s.getFromTable(t, key)
+	}
+
+	for i := len(level0) - 1; i > -1; i-- {
+		table := level0[i]
+		if !table.contain(s.cmp, key) {
+			continue
+		}
+		if val, ok, err := probe(table, 0); err != nil || ok {
+			return val, ok
 		}
 	}
 
-	for _, tables := range s.levels {
+	for level, tables := range levels {
 		if len(tables) == 0 {
 			continue
 		}
-		if idx := tables.search(s.cmp, key); idx != -1 {
-			reader, err := s.open(tables[idx])
-			if err != nil {
-				return nil, false
-			}
-			if val, err := reader.Get(key); err == nil {
-				return val, true
+		// end of range tombstone is the largest key of a table, it may be the smallest
+		// key of next table
+		idx := tables.search(s.cmp, key)
+		for ; idx != -1 && idx < len(tables) && tables[idx].contain(s.cmp, key); idx++ {
+			if val, ok, err := probe(tables[idx], level+1); err != nil || ok {
+				return val, ok
 			}
 		}
 	}
@@ -215,69 +495,280 @@ func (s *Storage) get(key []byte) ([]byte, bool) {
 	return nil, false
 }
 
+// chargeSeek charge a lookup which read table without finding key in it, table is
+// scheduled for compaction once its allowed seeks are used up
+func (s *Storage) chargeSeek(t *table, level int) {
+	if t.seeks.Add(1) != t.allowedSeeks() {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seekCompact == nil {
+		s.seekCompact, s.seekCompactLevel = t, level
+		s.checkCompaction()
+	}
+}
+
+// recordReadSample charge the first table containing key if more tables contain it,
+// it's called for keys sampled by iterators, since reading them merges these tables
+func (s *Storage) recordReadSample(key []byte) {
+	s.mu.RLock()
+	var first *table
+	firstLevel, matches := 0, 0
+	match := func(t *table, level int) {
+		if matches += 1; matches == 1 {
+			first, firstLevel = t, level
+		}
+	}
+	for i := len(s.level0) - 1; i > -1; i-- {
+		if s.level0[i].contain(s.cmp, key) {
+			match(s.level0[i], 0)
+		}
+	}
+	for level, ts := range s.levels {
+		if idx := ts.search(s.cmp, key); idx != -1 {
+			match(ts[idx], level+1)
+		}
+	}
+	s.mu.RUnlock()
+
+	if matches >= 2 {
+		s.chargeSeek(first, firstLevel)
+	}
+}
+
+func (s *Storage) getFromTable(t *table, key []byte) ([]byte, bool, error) {
+	reader, err := s.open(t)
+	if err != nil {
+		log.Printf("lsm-tree: %v", err)
+		return nil, false, err
+	}
+	defer reader.Unref()
+	// check filter first to avoid reading data block
+	if reader.MayContain(key) {
+		if val, err := reader.Get(key); err == nil {
+			return val, true, nil
+		}
+	}
+	// range tombstones only delete keys of older tables
+	if iterator.Covered(s.cmp, reader.RangeTombstones(), key) {
+		return encodeValue(kindDeletion, nil), true, nil
+	}
+	return nil, false, nil
+}
+
+// open return reader of table with a reference added, caller must Unref it
 func (s *Storage) open(t *table) (*sstable.TableReader, error) {
+	for {
+		r, err := s.cachedReader(t)
+		if err != nil {
+			return nil, err
+		}
+		// reader may be evicted and closed since it's got from cache
+		if r.Ref() {
+			return r, nil
+		}
+	}
+}
+
+// cachedReader return reader of table from table cache, the reference held by cache is
+// released when it's evicted
+func (s *Storage) cachedReader(t *table) (*sstable.TableReader, error) {
+	var err error
 	r := s.tableCache.Get(t.id, func() (interface{}, int64) {
 		name := t.getTableName()
-		f, err := openFile(name, true)
-		if err != nil {
+		f, openErr := openFile(name, true)
+		if openErr != nil {
+			err = openErr
 			return nil, 0
 		}
 
+		var ra io.ReaderAt = f
+		if s.db.cfg.Mmap {
+			m, mmapErr := sstable.NewMmapReader(f, t.size)
+			// mapping stays valid after file is closed
+			f.Close()
+			if mmapErr != nil {
+				err = mmapErr
+				return nil, 0
+			}
+			ra = m
+		}
+
 		nsCache := cache.NewNamespaceCache(s.blockCache, t.id)
 
-		reader, err := sstable.NewTableReader(f, s.cmp, t.size, nsCache)
-		if err != nil {
+		reader, openErr := sstable.NewTableReader(ra, s.tableOpts, t.size, nsCache)
+		if openErr != nil {
+			// file or mapping
+			ra.(io.Closer).Close()
+			err = openErr
 			return nil, 0
 		}
 		return reader, 1
 	})
 
 	if r == nil {
-		return nil, fmt.Errorf("open table: %v err", t)
+		s.tableCache.Remove(t.id)
+		if err != nil {
+			return nil, fmt.Errorf("open table %v err: %w", t.id, err)
+		}
+		return nil, fmt.Errorf("open table %v err", t.id)
 	}
 	return r.(*sstable.TableReader), nil
 }
 
-func (s *Storage) newIterator(t *table) iterator.Iterator {
-	r, err := s.open(t)
-	if err != nil {
-		return nil
+// getIterators return iterators of tables of version, newer data comes first, and range
+// tombstones of each iterator. If prefix isn't nil, tables and blocks whose filter rules out
+// the prefix are skipped. Readers are referenced by refs.
+func (s *Storage) getIterators(v *version, refs *tableRefs, prefix []byte) ([]iterator.Iterator, [][]iterator.RangeTombstone) {
+	iters := make([]iterator.Iterator, 0, len(v.level0)+len(v.levels))
+	tombstones := make([][]iterator.RangeTombstone, 0, cap(iters))
+	add := func(t *table) {
+		if iter, ts := s.newPrefixIterator(refs, t, prefix); iter != nil {
+			iters = append(iters, iter)
+			tombstones = append(tombstones, ts)
+		}
 	}
-	return r.NewIterator()
+	for i := len(v.level0) - 1; i > -1; i-- {
+		add(v.level0[i])
+	}
+	for _, level := range v.levels {
+		if prefix == nil {
+			iters = append(iters, iterator.NewTwoLevelIterator(level.newIndexIterator(refs, s.cmp)))
+			tombstones = append(tombstones, s.rangeTombstones(refs, level))
+			continue
+		}
+		// key range only rules out tables if keys with prefix follow the prefix
+		if _, ok := s.cmp.(compare.PrefixOrdered); ok {
+			level = level.overlapPrefix(s.cmp, prefix)
+		}
+		for _, t := range level {
+			add(t)
+		}
+	}
+	return iters, tombstones
 }
 
-func (s *Storage) getIterators() []iterator.Iterator {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// version is a copy of levels, tables of a referenced version aren't removed by compaction
+// until it's released
+type version struct {
+	level0 tables
+	levels []tables
+}
+
+// refVersion return current version with its tables referenced, caller must release it by unrefVersion
+func (s *Storage) refVersion() *version {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v := &version{
+		level0: append(tables{}, s.level0...),
+		levels: make([]tables, 0, len(s.levels)),
+	}
+	for _, ts := range s.levels {
+		v.levels = append(v.levels, append(tables{}, ts...))
+	}
+	for _, t := range v.allTables() {
+		t.refs += 1
+	}
+	return v
+}
+
+// unrefVersion release references of version, obsolete tables no longer referred to are removed
+func (s *Storage) unrefVersion(v *version) {
+	s.mu.Lock()
+	removed := make(tables, 0)
+	for _, t := range v.allTables() {
+		t.refs -= 1
+		if t.refs == 0 && t.obsolete {
+			removed = append(removed, t)
+		}
+	}
+	s.mu.Unlock()
+
+	s.removeTables(removed)
+}
 
-	iters := make([]iterator.Iterator, 0, len(s.level0)+len(s.levels))
-	for _, table := range s.level0 {
-		iters = append(iters, s.newIterator(table))
+func (v *version) allTables() tables {
+	ts := append(tables{}, v.level0...)
+	for _, level := range v.levels {
+		ts = append(ts, level...)
 	}
-	for _, level := range s.levels {
-		iters = append(iters, level.newIndexIterator(s, s.cmp))
+	return ts
+}
+
+// removeTables remove files of obsolete tables
+func (s *Storage) removeTables(ts tables) {
+	for _, t := range ts {
+		// drop reference of table cache, file or mapping is released once iterators reading the table are closed
+		s.tableCache.Remove(t.id)
+		if err := removeFile(t.getTableName()); err != nil {
+			log.Printf("lsm-tree: remove useless file err: %v", err)
+		}
+	}
+}
+
+// newPrefixIterator return iterator and range tombstones of table, iterator is nil if table
+// neither contains prefix nor deletes keys
+func (s *Storage) newPrefixIterator(refs *tableRefs, t *table, prefix []byte) (iterator.Iterator, []iterator.RangeTombstone) {
+	r, err := refs.open(t)
+	if err != nil {
+		log.Printf("lsm-tree: %v", err)
+		return nil, nil
+	}
+	if prefix == nil {
+		return r.NewIterator(), r.RangeTombstones()
+	}
+	if !r.MayContainPrefix(prefix) && len(r.RangeTombstones()) == 0 {
+		return nil, nil
+	}
+	return r.NewPrefixIterator(prefix), r.RangeTombstones()
+}
+
+// rangeTombstones return range tombstones of tables
+func (s *Storage) rangeTombstones(refs *tableRefs, ts tables) []iterator.RangeTombstone {
+	var tombstones []iterator.RangeTombstone
+	for _, t := range ts {
+		r, err := refs.open(t)
+		if err != nil {
+			log.Printf("lsm-tree: %v", err)
+			continue
+		}
+		tombstones = append(tombstones, r.RangeTombstones()...)
 	}
-	return iters
+	return tombstones
 }
 
-func (s *Storage) newTable() *tWriter {
+// newTable create table writer, writes are charged to rate limiter with pri
+func (s *Storage) newTable(pri ioPriority) *tWriter {
 	tid := s.newFileId()
 	tFile, err := openFile(fileName(SstableFile, tid), false)
 	if err != nil {
 		panic(err)
 	}
 
-	w := sstable.NewTableWriter(tFile, DefaultBlockSize)
+	var file io.WriteCloser = tFile
+	if limiter := s.db.cfg.RateLimiter; limiter != nil {
+		file = &rateLimitedWriter{WriteCloser: tFile, limiter: limiter, pri: pri}
+	}
+	w := sstable.NewTableWriter(file, s.tableOpts)
 	return &tWriter{
 		id: tid,
 		w:  w,
 	}
 }
 
-func (s *Storage) addTable(level int, t *table) {
+// addTable add table to level, blob files referenced by the table are recorded together
+func (s *Storage) addTable(level int, t *table, blobs ...*blobFile) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if len(blobs) > 0 {
+		// no file is dropped, old version can be released under lock
+		s.unrefBlobs(s.updateBlobs(blobs))
+	}
+
 	if level == 0 {
 		s.level0 = append(s.level0, t)
 	} else {
@@ -287,10 +778,16 @@ func (s *Storage) addTable(level int, t *table) {
 		s.levels[level-1] = append(s.levels[level-1], t)
 	}
 
+	if err := s.saveManifest(); err != nil {
+		log.Printf("lsm-tree: save manifest err: %v", err)
+	}
 	s.checkCompaction()
 }
 
 func (s *Storage) numTables(level int) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	if level == 0 {
 		return len(s.level0)
 	}
@@ -300,50 +797,133 @@ func (s *Storage) numTables(level int) int {
 	return len(s.levels[level-1])
 }
 
+// levelSize return total size of tables in level, level should be greater than 0
+func (s *Storage) levelSize(level int) uint64 {
+	size := uint64(0)
+	for _, t := range s.levels[level-1] {
+		size += t.size
+	}
+	return size
+}
+
+// levelTables return tables of level, caller should hold s.mu
+func (s *Storage) levelTables(level int) tables {
+	if level == 0 {
+		return s.level0
+	}
+	return s.levels[level-1]
+}
+
+// checkCompaction schedule compaction if compaction policy needs one. It doesn't block if
+// compaction requests are piling up, since levels are rechecked after each compaction.
 func (s *Storage) checkCompaction() {
-	if len(s.level0) > Level0FileNumber {
-		s.db.levelCompact <- compactRange{level: 0}
+	level := s.policy.CompactionLevel(&LevelsView{s})
+	if level == -1 {
 		return
 	}
 
-	for level, tables := range s.levels {
-		totalSize := uint64(0)
-		for _, t := range tables {
-			totalSize += t.size
-		}
-		if totalSize >= levelFilesSize(level+1) {
-			s.db.levelCompact <- compactRange{level: level + 1}
-			return
+	select {
+	case s.db.levelCompact <- compactRange{level: level}:
+	default:
+	}
+}
+
+// pickCompaction return next compaction picked by compaction policy, nil if no compaction
+// is needed. Tables of the compaction are marked as being compacted until released.
+func (s *Storage) pickCompaction() *compaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.policy.PickCompaction(&LevelsView{s})
+	if c == nil {
+		return nil
+	}
+	compact := c.c
+	if compact == nil {
+		if compact = s.resolveCompaction(c); compact == nil {
+			return nil
 		}
 	}
+	for _, t := range compact.allTables() {
+		s.compacting[t.id] = true
+	}
+	return compact
 }
 
-func (s *Storage) checkLevelCompaction(level int) bool {
-	if level == 0 {
-		return len(s.level0) > Level0FileNumber
+func (s *Storage) releaseCompaction(compact *compaction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range compact.allTables() {
+		delete(s.compacting, t.id)
 	}
+}
 
-	totalSize := uint64(0)
-	for _, table := range s.levels[level-1] {
-		totalSize += table.size
+// isCompacting report whether any of tables is being compacted, caller should hold s.mu
+func (s *Storage) isCompacting(ts ...*table) bool {
+	for _, t := range ts {
+		if s.compacting[t.id] {
+			return true
+		}
 	}
-	return totalSize >= levelFilesSize(level)
+	return false
 }
 
-func (s *Storage) pickCompaction(level int) *compaction {
-	comp := compaction{
-		level: level,
+// tableProps return properties of table, tables without recorded sequence number, e.g.
+// ingested tables, use their global sequence number
+func (s *Storage) tableProps(t *table) *tableProps {
+	if props := t.props.Load(); props != nil {
+		return props
 	}
 
-	flevel := make(tables, 0)
-	if level == 0 {
-		flevel = append(flevel, s.level0...)
+	props := &tableProps{}
+	if r, err := s.open(t); err != nil {
+		log.Printf("lsm-tree: %v", err)
 	} else {
-		flevel = append(flevel, s.levels[level-1][0])
+		props = newTableProps(r.Properties())
+		r.Unref()
 	}
+	if props.largestSeq == 0 {
+		props.largestSeq = t.seqNum
+	}
+	t.props.Store(props)
+	return props
+}
+
+// compensatedSize return size of table with tombstones weighted, each of them is expected
+// to remove an entry of average size in deeper levels
+func (s *Storage) compensatedSize(t *table) uint64 {
+	props := s.tableProps(t)
+	if props.numEntries == 0 {
+		return t.size
+	}
+	avg := (props.rawKeySize + props.rawValueSize) / props.numEntries
+	return t.size + props.numDeletions*avg*uint64(DeletionWeight)
+}
+
+// largestSeq return the largest sequence number of tables
+func (s *Storage) largestSeq(ts tables) uint64 {
+	seq := uint64(0)
+	for _, t := range ts {
+		if n := s.tableProps(t).largestSeq; n > seq {
+			seq = n
+		}
+	}
+	return seq
+}
+
+// nextSequence return a new sequence number, it's persisted with the next manifest
+func (s *Storage) nextSequence() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSequence += 1
+	return s.lastSequence
+}
 
-	minKey, maxKey := flevel[0].minKey, flevel[0].maxKey
-	for _, t := range comp.tables[0] {
+// keyRange return the smallest and largest key of tables
+func (s *Storage) keyRange(ts tables) (minKey, maxKey []byte) {
+	minKey, maxKey = ts[0].minKey, ts[0].maxKey
+	for _, t := range ts[1:] {
 		if s.cmp.Compare(t.minKey, minKey) < 0 {
 			minKey = t.minKey
 		}
@@ -351,11 +931,25 @@ func (s *Storage) pickCompaction(level int) *compaction {
 			maxKey = t.maxKey
 		}
 	}
+	return minKey, maxKey
+}
 
-	comp.tables[0] = flevel
-	comp.tables[1] = s.overlapTables(level+1, minKey, maxKey)
+// isBottommost report whether deeper levels have no data in key range of compaction, so
+// tombstones have nothing left to delete
+func (s *Storage) isBottommost(compact *compaction) bool {
+	if compact.outputLevel == 0 {
+		return false
+	}
 
-	return &comp
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	minKey, maxKey := s.keyRange(compact.allTables())
+	for level := compact.outputLevel + 1; level <= len(s.levels); level++ {
+		if len(s.overlapTables(level, minKey, maxKey)) > 0 {
+			return false
+		}
+	}
+	return true
 }
 
 func (s *Storage) overlapTables(level int, minKey, maxKey []byte) []*table {
@@ -372,7 +966,41 @@ func (s *Storage) overlapTables(level int, minKey, maxKey []byte) []*table {
 	return tables
 }
 
-func (s *Storage) applyCompaction(level int, addTable, deleteTable []*table) {
+// moveTable move table to another level, file of table is kept. Compaction pointer of level
+// moves to compactPointer unless it's nil.
+func (s *Storage) moveTable(t *table, level, outputLevel int, compactPointer []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	remove := func(ts []*table) []*table {
+		newTables := make([]*table, 0, len(ts))
+		for _, lt := range ts {
+			if lt.id != t.id {
+				newTables = append(newTables, lt)
+			}
+		}
+		return newTables
+	}
+	if level == 0 {
+		s.level0 = remove(s.level0)
+	} else {
+		s.levels[level-1] = remove(s.levels[level-1])
+	}
+
+	s.levels[outputLevel-1] = append(s.levels[outputLevel-1], t)
+	s.levels[outputLevel-1].sort(s.cmp)
+	if compactPointer != nil {
+		s.compactPointers[level] = compactPointer
+	}
+
+	if err := s.saveManifest(); err != nil {
+		log.Printf("lsm-tree: save manifest err: %v", err)
+	}
+}
+
+// applyCompaction replace input tables of compaction with addTable in output level
+func (s *Storage) applyCompaction(compact *compaction, addTable []*table) {
+	deleteTable := compact.allTables()
 	deleteMap := make(map[uint64]struct{})
 	for _, dt := range deleteTable {
 		deleteMap[dt.id] = struct{}{}
@@ -390,26 +1018,50 @@ func (s *Storage) applyCompaction(level int, addTable, deleteTable []*table) {
 
 	s.mu.Lock()
 
-	if level == 0 {
-		s.level0 = cleanup(s.level0)
-	} else {
-		s.levels[level-1] = cleanup(s.levels[level-1])
+	// output of level 0 takes the place of the oldest input, so order of level 0 is kept
+	pos := len(s.level0)
+	for i, t := range s.level0 {
+		if _, exist := deleteMap[t.id]; exist {
+			pos = i
+			break
+		}
+	}
+	s.level0 = cleanup(s.level0)
+	for i := range s.levels {
+		s.levels[i] = cleanup(s.levels[i])
 	}
 
-	s.levels[level] = append(cleanup(s.levels[level]), addTable...)
-	s.levels[level].sort(s.cmp)
-
-	s.mu.Unlock()
+	if compact.outputLevel == 0 {
+		level0 := make([]*table, 0, len(s.level0)+len(addTable))
+		level0 = append(level0, s.level0[:pos]...)
+		level0 = append(level0, addTable...)
+		s.level0 = append(level0, s.level0[pos:]...)
+	} else {
+		s.levels[compact.outputLevel-1] = append(s.levels[compact.outputLevel-1], addTable...)
+		s.levels[compact.outputLevel-1].sort(s.cmp)
+	}
+	// failed compaction doesn't move the pointer, so its range is picked again
+	if compact.compactPointer != nil {
+		s.compactPointers[compact.level] = compact.compactPointer
+	}
 
+	if err := s.saveManifest(); err != nil {
+		log.Printf("lsm-tree: save manifest err: %v", err)
+	}
+	// tables referred to by versions are removed once versions are released
+	removed := make(tables, 0, len(deleteTable))
 	for _, dt := range deleteTable {
-		if err := removeFile(dt.getTableName()); err != nil {
-			log.Printf("lsm-tree: remove useless file err: %v", err)
+		dt.obsolete = true
+		if dt.refs == 0 {
+			removed = append(removed, dt)
 		}
 	}
+	s.mu.Unlock()
+
+	s.removeTables(removed)
 }
 
+// newFileId is called by concurrent flush and compactions without s.mu
 func (s *Storage) newFileId() uint64 {
-	id := s.nextFileId
-	s.nextFileId += 1
-	return id
+	return atomic.AddUint64(&s.nextFileId, 1) - 1
 }
@@ -0,0 +1,149 @@
+package lsm
+
+// UniversalCompactionPolicy merges sorted runs of similar size, also known as size-tiered
+// compaction. Each table of level 0 and each non-empty level is a sorted run. It has lower
+// write amplification than leveled compaction at the cost of read and space amplification.
+type UniversalCompactionPolicy struct {
+	// SizeRatio merges a run with newer runs if it is at most SizeRatio percent
+	// larger than their total size
+	SizeRatio int
+	// MinMergeWidth is the minimum number of runs merged for size ratio
+	MinMergeWidth int
+	// MaxMergeWidth is the maximum number of runs merged for size ratio, 0 means unlimited
+	MaxMergeWidth int
+	// MaxSizeAmplificationPercent merges all runs once size of all runs but the oldest one
+	// is more than MaxSizeAmplificationPercent percent of the oldest run
+	MaxSizeAmplificationPercent int
+	// MaxSortedRuns is the number of runs above which compaction is triggered,
+	// runs are merged to keep the number of runs under it
+	MaxSortedRuns int
+}
+
+func NewUniversalCompactionPolicy() *UniversalCompactionPolicy {
+	return &UniversalCompactionPolicy{
+		SizeRatio:                   1,
+		MinMergeWidth:               2,
+		MaxSizeAmplificationPercent: 200,
+		MaxSortedRuns:               Level0FileNumber,
+	}
+}
+
+type sortedRun struct {
+	level  int
+	tables tables
+	size   uint64
+}
+
+// sortedRuns return runs from the newest to the oldest
+func (p *UniversalCompactionPolicy) sortedRuns(s *Storage) []sortedRun {
+	runs := make([]sortedRun, 0, len(s.level0)+len(s.levels))
+	for i := len(s.level0) - 1; i >= 0; i-- {
+		t := s.level0[i]
+		runs = append(runs, sortedRun{level: 0, tables: tables{t}, size: t.size})
+	}
+	for level := 1; level <= len(s.levels); level++ {
+		if len(s.levels[level-1]) > 0 {
+			runs = append(runs, sortedRun{level: level, tables: s.levels[level-1], size: s.levelSize(level)})
+		}
+	}
+	return runs
+}
+
+func (p *UniversalCompactionPolicy) CompactionLevel(v *LevelsView) int {
+	if c := p.pickCompaction(v.s); c != nil {
+		return c.level
+	}
+	return -1
+}
+
+func (p *UniversalCompactionPolicy) PickCompaction(v *LevelsView) *Compaction {
+	return v.export(p.pickCompaction(v.s))
+}
+
+// pickCompaction try to reduce space amplification first, then merge runs of similar size.
+// If neither applies but there are still too many runs, the newest runs are merged.
+func (p *UniversalCompactionPolicy) pickCompaction(s *Storage) *compaction {
+	// runs may change once running compaction is done
+	if len(s.compacting) > 0 {
+		return nil
+	}
+
+	runs := p.sortedRuns(s)
+	if len(runs) <= p.MaxSortedRuns {
+		return nil
+	}
+
+	if c := p.pickSizeAmp(s, runs); c != nil {
+		return c
+	}
+	if c := p.pickSizeRatio(s, runs); c != nil {
+		return c
+	}
+
+	n := len(runs) - p.MaxSortedRuns + 1
+	if n < 2 {
+		n = 2
+	}
+	return p.newCompaction(s, runs, n)
+}
+
+func (p *UniversalCompactionPolicy) pickSizeAmp(s *Storage, runs []sortedRun) *compaction {
+	last := runs[len(runs)-1]
+	newer := uint64(0)
+	for _, r := range runs[:len(runs)-1] {
+		newer += r.size
+	}
+	if newer*100 <= last.size*uint64(p.MaxSizeAmplificationPercent) {
+		return nil
+	}
+	return p.newCompaction(s, runs, len(runs))
+}
+
+func (p *UniversalCompactionPolicy) pickSizeRatio(s *Storage, runs []sortedRun) *compaction {
+	minWidth := p.MinMergeWidth
+	if minWidth < 2 {
+		minWidth = 2
+	}
+
+	for start := 0; start+minWidth <= len(runs); start++ {
+		total, end := runs[start].size, start+1
+		for ; end < len(runs); end++ {
+			if p.MaxMergeWidth > 0 && end-start >= p.MaxMergeWidth {
+				break
+			}
+			if total*uint64(100+p.SizeRatio) < runs[end].size*100 {
+				break
+			}
+			total += runs[end].size
+		}
+		if end-start >= minWidth {
+			return p.newCompaction(s, runs[start:], end-start)
+		}
+	}
+	return nil
+}
+
+// newCompaction merge the first n runs. Output goes to the level of the oldest input
+// run, or as deep as possible if the oldest input is a table of level 0.
+func (p *UniversalCompactionPolicy) newCompaction(s *Storage, runs []sortedRun, n int) *compaction {
+	comp := &compaction{
+		level: runs[0].level,
+	}
+	for _, r := range runs[:n] {
+		comp.inputs = append(comp.inputs, r.tables)
+	}
+
+	last := runs[n-1]
+	switch {
+	case last.level > 0:
+		comp.outputLevel = last.level
+	case last.tables[0] != s.level0[0]:
+		// older tables of level 0 are left, output must stay above them
+		comp.outputLevel = 0
+	case n < len(runs):
+		comp.outputLevel = runs[n].level - 1
+	default:
+		comp.outputLevel = len(s.levels)
+	}
+	return comp
+}
@@ -6,16 +6,19 @@ import (
 	"time"
 )
 
-func createDir() error {
-	DirectoryPath = fmt.Sprintf("./lsm/%v", time.Now())
+func createDir(dir string) error {
+	if dir == "" {
+		dir = fmt.Sprintf("./lsm/%v", time.Now())
+	}
+	DirectoryPath = dir
 	return os.MkdirAll(DirectoryPath, 0777)
 }
 
-// create file if doesnt exist
+// open file for reading, or create file for writing if doesnt exist
 func openFile(fname string, readOnly bool) (*os.File, error) {
-	flag := os.O_CREATE | os.O_RDONLY
+	flag := os.O_RDONLY
 	if !readOnly {
-		flag |= os.O_RDWR
+		flag = os.O_CREATE | os.O_RDWR
 	}
 	file, err := os.OpenFile(fname, flag, 0640)
 	if err != nil {
@@ -29,10 +32,28 @@ func fileName(ftype FileType, id uint64) string {
 		return fmt.Sprintf("%v/sst-%v.ldb", DirectoryPath, id)
 	} else if ftype == LogFile {
 		return fmt.Sprintf("%v/log-%v.log", DirectoryPath, id)
+	} else if ftype == ManifestFile {
+		return fmt.Sprintf("%v/MANIFEST", DirectoryPath)
+	} else if ftype == BlobFile {
+		return fmt.Sprintf("%v/blob-%v.blob", DirectoryPath, id)
 	}
 	return ""
 }
 
+// parseFileName return the type and id of a file in the database directory
+func parseFileName(name string) (ftype FileType, id uint64, ok bool) {
+	if _, err := fmt.Sscanf(name, "sst-%d.ldb", &id); err == nil {
+		return SstableFile, id, true
+	}
+	if _, err := fmt.Sscanf(name, "log-%d.log", &id); err == nil {
+		return LogFile, id, true
+	}
+	if _, err := fmt.Sscanf(name, "blob-%d.blob", &id); err == nil {
+		return BlobFile, id, true
+	}
+	return 0, 0, false
+}
+
 func removeFile(fname string) error {
 	return os.Remove(fname)
 }
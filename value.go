@@ -0,0 +1,73 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+type valueKind uint8
+
+const (
+	kindValue valueKind = iota
+	kindBlobIndex
+	// tombstone of a deleted key, it has no data
+	kindDeletion
+)
+
+var errCorruptedValue = errors.New("corrupted value")
+
+/*
+values are stored in memtable and sstables with their kind:
+
+	| kind (1 byte) | data |
+
+data of blob index:
+
+	| blob file id | offset of value | len of value |
+*/
+func encodeValue(kind valueKind, data []byte) []byte {
+	v := make([]byte, len(data)+1)
+	v[0] = byte(kind)
+	copy(v[1:], data)
+	return v
+}
+
+func decodeValue(v []byte) (valueKind, []byte, error) {
+	if len(v) == 0 {
+		return 0, nil, errCorruptedValue
+	}
+	return valueKind(v[0]), v[1:], nil
+}
+
+// isDeletion report whether v is a tombstone
+func isDeletion(v []byte) bool {
+	return len(v) > 0 && valueKind(v[0]) == kindDeletion
+}
+
+// blobIndex points to a value stored in blob file
+type blobIndex struct {
+	fileId uint64
+	offset uint64
+	size   uint64
+}
+
+func (b blobIndex) encode() []byte {
+	buf := make([]byte, 0, binary.MaxVarintLen64*3)
+	buf = binary.AppendUvarint(buf, b.fileId)
+	buf = binary.AppendUvarint(buf, b.offset)
+	buf = binary.AppendUvarint(buf, b.size)
+	return buf
+}
+
+func decodeBlobIndex(data []byte) (blobIndex, error) {
+	d := &decoder{buf: data}
+	idx := blobIndex{
+		fileId: d.uvarint(),
+		offset: d.uvarint(),
+		size:   d.uvarint(),
+	}
+	if d.err != nil {
+		return blobIndex{}, errCorruptedValue
+	}
+	return idx, nil
+}